@@ -0,0 +1,231 @@
+package gsync
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+//StateDir is the hidden directory in an app dir where the client keeps its state
+const StateDir = ".gsync"
+
+const backupManifest = "backup.json"
+
+//BackupFile records a file before it was changed by an update
+type BackupFile struct {
+	Path    string
+	Mode    os.FileMode
+	ModTime time.Time
+	//Created is set if the file didn't exist before the update
+	Created bool `json:",omitempty"`
+}
+
+//Backup holds files replaced, created and removed in one update
+type Backup struct {
+	ID       string
+	Time     time.Time
+	Files    []BackupFile
+	Complete bool
+
+	applydir string
+	saved    map[string]bool
+}
+
+func backupsDir(applydir string) string {
+	return filepath.Join(applydir, StateDir, "backups")
+}
+
+func (b *Backup) dir() string {
+	return filepath.Join(backupsDir(b.applydir), b.ID)
+}
+
+func (b *Backup) writeManifest() error {
+	content, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	tmpfile := filepath.Join(b.dir(), backupManifest+".tmp")
+	if err = ioutil.WriteFile(tmpfile, content, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmpfile, filepath.Join(b.dir(), backupManifest))
+}
+
+//BeginBackup starts a new backup set of applydir
+func BeginBackup(applydir string) (*Backup, error) {
+	now := time.Now()
+	b := &Backup{
+		ID:       now.Format("20060102-150405.000000"),
+		Time:     now,
+		Files:    make([]BackupFile, 0),
+		applydir: applydir,
+		saved:    make(map[string]bool),
+	}
+	if err := os.MkdirAll(b.dir(), 0777); err != nil {
+		return nil, err
+	}
+	HideFile(filepath.Join(applydir, StateDir))
+	return b, b.writeManifest()
+}
+
+//Save backs up file name of the app dir before it is replaced or removed.
+//files saved before are skipped
+func (b *Backup) Save(name string) error {
+	name = normpath(name)
+	if b.saved[name] {
+		return nil
+	}
+	src := filepath.Join(b.applydir, filepath.FromSlash(name))
+	fi, err := os.Stat(src)
+	if os.IsNotExist(err) {
+		b.Files = append(b.Files, BackupFile{Path: name, Created: true})
+	} else if err != nil {
+		return err
+	} else {
+		if err = copyFile(src, filepath.Join(b.dir(), "files", filepath.FromSlash(name)), true); err != nil {
+			return err
+		}
+		b.Files = append(b.Files, BackupFile{Path: name, Mode: fi.Mode(), ModTime: fi.ModTime()})
+	}
+	b.saved[name] = true
+	return b.writeManifest()
+}
+
+//Commit marks the backup complete and keeps at most keep backups
+func (b *Backup) Commit(keep int) error {
+	b.Complete = true
+	if err := b.writeManifest(); err != nil {
+		return err
+	}
+	return PruneBackups(b.applydir, keep)
+}
+
+//Discard removes the backup, used if the update changed nothing
+func (b *Backup) Discard() error {
+	return os.RemoveAll(b.dir())
+}
+
+//restore puts files of the backup back into the app dir
+func (b *Backup) restore() ([]string, error) {
+	restores := make([]string, 0)
+	for i := len(b.Files) - 1; i >= 0; i-- {
+		f := b.Files[i]
+		dst := filepath.Join(b.applydir, filepath.FromSlash(f.Path))
+		if f.Created {
+			if _, err := RemoveFiles(b.applydir, []string{f.Path}, nil); err != nil {
+				return restores, err
+			}
+			restores = append(restores, dst)
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(b.dir(), "files", filepath.FromSlash(f.Path)))
+		if err != nil {
+			return restores, err
+		}
+		if err = ReplaceFile(content, dst, f.Mode, f.ModTime); err != nil {
+			return restores, err
+		}
+		restores = append(restores, dst)
+	}
+	return restores, b.Discard()
+}
+
+func loadBackup(applydir string, id string) (*Backup, error) {
+	content, err := ioutil.ReadFile(filepath.Join(backupsDir(applydir), id, backupManifest))
+	if err != nil {
+		return nil, err
+	}
+	b := &Backup{}
+	if err = json.Unmarshal(content, b); err != nil {
+		return nil, err
+	}
+	b.applydir = applydir
+	b.saved = make(map[string]bool)
+	for _, f := range b.Files {
+		b.saved[f.Path] = true
+	}
+	return b, nil
+}
+
+//Backups lists complete backups of applydir, newest first.
+//incomplete ones belong to updates interrupted before they were journaled, see removeIncompleteBackups
+func Backups(applydir string) ([]*Backup, error) {
+	fis, err := ioutil.ReadDir(backupsDir(applydir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var backups []*Backup
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			continue
+		}
+		b, err := loadBackup(applydir, fi.Name())
+		if err != nil || !b.Complete {
+			continue
+		}
+		backups = append(backups, b)
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].ID > backups[j].ID })
+	return backups, nil
+}
+
+//removeIncompleteBackups removes backups never completed, except the one of a journaled update
+func removeIncompleteBackups(applydir string, except string) error {
+	fis, err := ioutil.ReadDir(backupsDir(applydir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if !fi.IsDir() || fi.Name() == except {
+			continue
+		}
+		//backups without manifest were interrupted in BeginBackup
+		if b, err := loadBackup(applydir, fi.Name()); err == nil && b.Complete {
+			continue
+		}
+		if err = os.RemoveAll(filepath.Join(backupsDir(applydir), fi.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//PruneBackups removes all but the newest keep backups of applydir
+func PruneBackups(applydir string, keep int) error {
+	backups, err := Backups(applydir)
+	if err != nil || keep <= 0 || len(backups) <= keep {
+		return err
+	}
+	for _, b := range backups[keep:] {
+		if err = b.Discard(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Rollback restores the last n updates of applydir, newest first
+func Rollback(applydir string, n int) ([]string, error) {
+	restores := make([]string, 0)
+	backups, err := Backups(applydir)
+	if err != nil {
+		return restores, err
+	}
+	for i := 0; i < n && i < len(backups); i++ {
+		files, err := backups[i].restore()
+		restores = append(restores, files...)
+		if err != nil {
+			return restores, err
+		}
+	}
+	return restores, nil
+}
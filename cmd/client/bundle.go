@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gsync"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+)
+
+const (
+	//files smaller than bundleMaxFileSize are downloaded in bundles if there are at least bundleMinFiles of them,
+	//bigger ones are downloaded one by one
+	bundleMaxFileSize = 256 * 1024
+	bundleMinFiles    = 8
+	//bundleMaxSize limits the total size of files in a bundle
+	bundleMaxSize = 32 * 1024 * 1024
+)
+
+//planBundles groups small files of diff into bundles, files not in any are downloaded one by one
+func planBundles(diff gsync.DiffMap) [][]string {
+	var small []string
+	for fname, d := range diff {
+		if d.NewSize < bundleMaxFileSize {
+			small = append(small, fname)
+		}
+	}
+	if len(small) < bundleMinFiles {
+		return nil
+	}
+	sort.Strings(small)
+	var bundles [][]string
+	var bundle []string
+	var size int64
+	for _, fname := range small {
+		if len(bundle) > 0 && size+diff[fname].NewSize > bundleMaxSize {
+			bundles = append(bundles, bundle)
+			bundle, size = nil, 0
+		}
+		bundle = append(bundle, fname)
+		size += diff[fname].NewSize
+	}
+	return append(bundles, bundle)
+}
+
+//requestBundle asks the server for a patch holding files of release
+func requestBundle(files []string, algo string, release string) (*gsync.Response, error) {
+	req := &gsync.Request{
+		ClientVersion: 3,
+		HashAlgo:      algo,
+		Release:       release,
+		Codec:         config.Codec,
+		Scope:         files,
+	}
+	requrl := fmt.Sprintf("%s/bundle/%s", serverURL(), config.SyncApp)
+	resp, err := postRequest(requrl, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("statusCode=%d, response=%s", resp.StatusCode, content)
+	}
+	var gresp gsync.Response
+	if err = json.Unmarshal(content, &gresp); err != nil {
+		return nil, err
+	}
+	return &gresp, nil
+}
+
+//stageBundle downloads files of diff in a bundle and stages them
+func stageBundle(tx *gsync.Transaction, files []string, diff gsync.DiffMap, algo string, release string) error {
+	//the bundle may be evicted from the server cache before it is downloaded, it is requested again then
+	for retry := 0; ; retry++ {
+		err := downloadBundle(tx, files, diff, algo, release)
+		if err != errNotFound || retry > 0 {
+			return err
+		}
+	}
+}
+
+func downloadBundle(tx *gsync.Transaction, files []string, diff gsync.DiffMap, algo string, release string) error {
+	bresp, err := requestBundle(files, algo, release)
+	if err != nil {
+		return err
+	}
+	//the bundle must hold exactly the files of the update
+	bundleDiff := make(gsync.DiffMap)
+	for _, fname := range files {
+		if bresp.Diff[fname].NewHash != diff[fname].NewHash {
+			return fmt.Errorf("file %s of bundle differs from update", fname)
+		}
+		bundleDiff[fname] = diff[fname]
+	}
+	if len(bresp.Diff) != len(files) || len(bresp.PatchFile) == 0 {
+		return fmt.Errorf("bundle differs from update")
+	}
+	rc, err := openDownload(serverURL()+bresp.PatchFile, path.Base(bresp.PatchFile))
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	staged, err := tx.StagePatch(rc, bundleDiff)
+	if err != nil {
+		return err
+	}
+	if len(staged) != len(files) {
+		return fmt.Errorf("bundle has %d of %d files", len(staged), len(files))
+	}
+	return nil
+}
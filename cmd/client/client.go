@@ -2,7 +2,6 @@ package main
 
 import (
 	"bufio"
-	"crypto/md5"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -14,24 +13,63 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+//files smaller than deltaMinSize are always downloaded as a whole
+const deltaMinSize = 64 * 1024
+
+//backups kept for rollback if not configed
+const defaultKeepBackups = 5
+
 var (
 	wd          string
+	autoupdate  string
 	config      SyncConfig
 	checkUpdate bool
+	rollback    int
+	//hashIndex caches hashes of files in SyncDir
+	hashIndex string
+	rehash    bool
 )
 
 type SyncConfig struct {
 	SyncDetail  bool `json:"-"`
 	SyncCounter int  `json:"-"`
+	SyncDaemon  bool `json:"-"`
 	SyncHost    string
 	SyncDir     string `json:"-"`
 	SyncApp     string
 	Ignore      []string
+	//Mirror removes local files which were removed on the server
+	Mirror bool
+	//KeepBackups is the number of updates which can be rolled back
+	KeepBackups int
+	//Retries is the number of times a failed download is resumed
+	Retries int
+	//Downloads is the number of files and bundles downloaded at the same time
+	Downloads int
+	//Interval is the check update interval of daemon, such as "10m"
+	Interval string
+	LogFile  string
+	//Token authorizes the client to access the app
+	Token string
+	HTTPS bool
+	//CACert is a pem file of the ca the server certificate must be signed by
+	CACert string
+	//CertFingerprint is the sha256 of the server certificate in hex
+	CertFingerprint string
+	ClientCert      string
+	ClientKey       string
+	//HashAlgo is the file hash algorithm: md5, sha256 or blake2b
+	HashAlgo string
+	//Codec compresses downloads: zstd(default), gzip or none
+	Codec string
+	//PublicKey verifies the signed manifest of the app, base64 encoded ed25519 key
+	PublicKey string
 }
 
 func usage() {
@@ -42,7 +80,7 @@ func usage() {
 func cleanTmpFiles(dir string) error {
 	fis, err := ioutil.ReadDir(dir)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	for _, fi := range fis {
 		fname := fi.Name()
@@ -63,10 +101,96 @@ func cleanTmpFiles(dir string) error {
 	return nil
 }
 
+func requestDeltas(req *gsync.Request) (map[string]*gsync.Delta, error) {
+	requrl := fmt.Sprintf("%s/delta/%s", serverURL(), config.SyncApp)
+	resp, err := postRequest(requrl, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("statusCode=%d, response=%s", resp.StatusCode, content)
+	}
+	var gresp gsync.Response
+	if err = json.Unmarshal(content, &gresp); err != nil {
+		return nil, err
+	}
+	return gresp.Deltas, nil
+}
+
+//requestManifest gets the manifest of release and verifies its signature
+func requestManifest(release string) (*gsync.Manifest, error) {
+	pub, err := gsync.ParsePublicKey(config.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	requrl := fmt.Sprintf("%s/manifest/%s?release=%s", serverURL(), config.SyncApp, url.QueryEscape(release))
+	resp, err := httpGet(requrl)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("statusCode=%d, response=%s", resp.StatusCode, content)
+	}
+	var sm gsync.SignedManifest
+	if err = json.Unmarshal(content, &sm); err != nil {
+		return nil, err
+	}
+	m, err := sm.Verify(pub)
+	if err != nil {
+		return nil, err
+	}
+	if m.App != config.SyncApp || m.Release != release {
+		return nil, fmt.Errorf("manifest of %s release %s was returned", m.App, m.Release)
+	}
+	if err = m.CheckTimestamp(config.SyncDir); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+//patchFile rebuilds file fname from its local content and delta into tx
+func patchFile(tx *gsync.Transaction, fname string, delta *gsync.Delta, d gsync.Diff) error {
+	fr, err := os.Open(filepath.Join(config.SyncDir, fname))
+	if err != nil {
+		return err
+	}
+	content, err := gsync.ApplyDelta(fr, delta)
+	fr.Close()
+	if err != nil {
+		return err
+	}
+	return tx.Stage(fname, content, d)
+}
+
+//recoverUpdate completes or reverts an update interrupted last time
+func recoverUpdate() error {
+	recovered, err := gsync.RecoverTransaction(config.SyncDir, config.KeepBackups)
+	if err != nil {
+		return fmt.Errorf("recover interrupted update error:%v", err)
+	}
+	if recovered {
+		log.Printf("recovered interrupted update\n")
+	}
+	return nil
+}
+
 func main() {
 	wd = filepath.Dir(os.Args[0])
 
 	defer func() {
+		if config.SyncDaemon {
+			return
+		}
 		reader := bufio.NewReader(os.Stdin)
 		fmt.Println("press any key to exit")
 		_, _ = reader.ReadByte()
@@ -76,141 +200,412 @@ func main() {
 	flag.StringVar(&config.SyncHost, "host", "", "sync server")
 	flag.StringVar(&config.SyncDir, "dir", "", "sync dir")
 	flag.StringVar(&config.SyncApp, "app", "", "sync app")
+	flag.BoolVar(&config.HTTPS, "https", false, "connect sync server with https")
 	flag.BoolVar(&checkUpdate, "check", false, "check update")
+	flag.IntVar(&rollback, "rollback", 0, "roll back the last n updates")
+	flag.BoolVar(&rehash, "rehash", false, "hash all files instead of using hashes cached")
+	flag.BoolVar(&config.SyncDaemon, "daemon", false, "keep running and check update periodically")
+	flag.StringVar(&config.Interval, "interval", "", "check update interval of daemon, such as 10m")
+	flag.StringVar(&config.LogFile, "logfile", "", "write logs to file")
 	flag.Parse()
 
-	autoupdate := filepath.Join(wd, ".autoupdate")
+	autoupdate = filepath.Join(wd, ".autoupdate")
 	content, err := ioutil.ReadFile(autoupdate)
 	if err == nil {
 		json.Unmarshal(content, &config)
 	}
 
+	if len(config.LogFile) > 0 {
+		if !filepath.IsAbs(config.LogFile) {
+			config.LogFile = filepath.Join(wd, config.LogFile)
+		}
+		f, err := os.OpenFile(config.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		log.SetOutput(f)
+	}
+
+	if len(config.SyncDir) == 0 {
+		config.SyncDir = wd
+	}
+	hashIndex = autoupdate + ".index"
+	//files of the client itself are never synced, nor removed by Mirror
+	own := []string{autoupdate, hashIndex, config.LogFile}
+	if exe, err := os.Executable(); err == nil {
+		own = append(own, exe)
+	}
+	syncDir, _ := filepath.Abs(config.SyncDir)
+	for _, fpath := range own {
+		if len(fpath) == 0 {
+			continue
+		}
+		fpath, _ = filepath.Abs(fpath)
+		if rel, err := filepath.Rel(syncDir, fpath); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			config.Ignore = append(config.Ignore, filepath.ToSlash(rel))
+		}
+	}
+	if config.KeepBackups == 0 {
+		config.KeepBackups = defaultKeepBackups
+	}
+	if config.Retries < 0 || config.Downloads < 0 {
+		log.Fatalf("invalid Retries %d or Downloads %d", config.Retries, config.Downloads)
+	}
+	if config.Retries == 0 {
+		config.Retries = defaultRetries
+	}
+	if config.Downloads == 0 {
+		config.Downloads = defaultDownloads
+	}
+	if len(config.HashAlgo) == 0 {
+		config.HashAlgo = gsync.HashSHA256
+	}
+	if !gsync.SupportedHash(config.HashAlgo) {
+		log.Fatalf("unsupported hash algorithm %s", config.HashAlgo)
+	}
+	if len(config.Codec) == 0 {
+		config.Codec = gsync.CodecZstd
+	}
+	if !gsync.SupportedCodec(config.Codec) {
+		log.Fatalf("unsupported codec %s", config.Codec)
+	}
+
+	if rollback > 0 {
+		if err := recoverUpdate(); err != nil {
+			log.Fatal(err)
+		}
+		restores, err := gsync.Rollback(config.SyncDir, rollback)
+		if config.SyncDetail {
+			log.Printf("restored %d files: %v\n", len(restores), restores)
+		}
+		if err != nil {
+			log.Fatalf("rollback error:%v", err)
+		}
+		log.Printf("rollback successfully\n")
+		return
+	}
 	if len(config.SyncHost) == 0 {
 		usage()
 		return
 	}
-	if len(config.SyncDir) == 0 {
-		config.SyncDir = wd
+	if err = setupHTTPClient(); err != nil {
+		log.Fatalf("setup https error:%v", err)
 	}
 	if config.SyncDetail {
 		log.Printf("sync app(%s) from %s\n", config.SyncApp, config.SyncHost)
 	}
 
-	//clean autoupdatetmpfiles
-	err = cleanTmpFiles(config.SyncDir)
-	if err != nil {
+	if config.SyncDaemon {
+		runDaemon()
+		return
+	}
+	if err := syncApp(); err != nil {
 		log.Println(err)
 	}
+}
 
-	req, err := gsync.MakeRequest(config.SyncDir, config.Ignore, true)
+//requestUpdate asks the server for differences of the app dir hashed with algo
+func requestUpdate(algo string) (*gsync.Request, *gsync.Response, error) {
+	idx := gsync.LoadHashIndex(hashIndex)
+	if rehash {
+		idx.Files = make(map[string]*gsync.IndexEntry)
+		rehash = false
+	}
+	req, err := gsync.MakeRequestWithIndex(config.SyncDir, config.Ignore, true, algo, idx)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
-	req.ClientVersion = 2
+	if err = idx.Save(); err != nil {
+		log.Printf("save hash index error:%v", err)
+	}
+	req.ClientVersion = 3
 
-	//check update
-	content, err = json.Marshal(req)
+	//check merkle roots first, hashes are sent only if they differ
+	probe := &gsync.Request{
+		ClientVersion: req.ClientVersion,
+		HashAlgo:      req.HashAlgo,
+		RootHash:      gsync.MerkleRoot(req.Hashes, req.HashAlgo),
+	}
+	gresp, err := postCheck(probe)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(gresp.RootHash) > 0 && gresp.RootHash == probe.RootHash {
+		return req, gresp, nil
+	}
+	if len(gresp.RootHash) > 0 && len(req.Hashes) >= merkleWalkMinFiles {
+		//send hashes of files in differing subtrees only
+		local := gsync.NewMerkleTree(req.Hashes, req.HashAlgo)
+		scope, err := walkTree(local, req.HashAlgo, gresp.Release)
+		if err == nil {
+			scoped := &gsync.Request{
+				ClientVersion: req.ClientVersion,
+				HashAlgo:      req.HashAlgo,
+				Release:       gresp.Release,
+				Hashes:        local.Files(scope),
+				Scope:         scope,
+			}
+			gresp, err = postCheck(scoped)
+			if err != nil {
+				return nil, nil, err
+			}
+			return scoped, gresp, nil
+		}
+		log.Printf("walk merkle tree error:%v, send all hashes instead", err)
+	}
+	//servers not knowing merkle roots compare hashes only
+	gresp, err = postCheck(req)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
+	return req, gresp, nil
+}
 
-	requrl := fmt.Sprintf("http://%s/hasupdate/%s", config.SyncHost, config.SyncApp)
+//postCheck posts req to /hasupdate
+func postCheck(req *gsync.Request) (*gsync.Response, error) {
+	requrl := fmt.Sprintf("%s/hasupdate/%s", serverURL(), config.SyncApp)
 	if config.SyncDetail {
+		content, _ := json.Marshal(req)
 		log.Printf("request %s. param:%s\n", requrl, content)
 	}
-	resp, err := http.PostForm(requrl, url.Values{"req": {string(content)}})
+	resp, err := postRequest(requrl, req)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	defer resp.Body.Close()
 
-	content, err = ioutil.ReadAll(resp.Body)
+	content, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	if config.SyncDetail {
 		log.Printf("response:%s\n", content)
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		log.Fatalf("check update error:%s", content)
+		return nil, fmt.Errorf("check update error:%s", content)
 	}
-	resp.Body.Close()
 
 	var gresp gsync.Response
 	err = json.Unmarshal(content, &gresp)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	return &gresp, nil
+}
+
+//syncApp checks update of the app and applies it
+func syncApp() error {
+	if err := recoverUpdate(); err != nil {
+		return err
+	}
+
+	//clean autoupdatetmpfiles
+	err := cleanTmpFiles(config.SyncDir)
+	if err != nil {
+		log.Println(err)
+	}
+
+	req, gresp, err := requestUpdate(config.HashAlgo)
+	if err != nil {
+		return err
+	}
+	if gsync.HashName(gresp.HashAlgo) != req.HashAlgo {
+		//servers not knowing hash algorithms always use md5
+		log.Printf("server doesn't support %s, check update with md5\n", req.HashAlgo)
+		if req, gresp, err = requestUpdate(gsync.HashMD5); err != nil {
+			return err
+		}
 	}
 
-	if len(gresp.Diff) == 0 {
+	if !config.Mirror {
+		gresp.Deleted = nil
+	}
+	if len(gresp.Diff) == 0 && len(gresp.Deleted) == 0 {
 		//no update
 		log.Printf("up to date\n")
-		return
+		return nil
 	} else {
 		if checkUpdate {
 			var totalSize int64
 			for _, d := range gresp.Diff {
 				totalSize += d.NewSize
 			}
-			log.Printf("has update. files:%d, size:%d", len(gresp.Diff), totalSize)
-			return
+			log.Printf("has update. files:%d, size:%d, deletes:%d", len(gresp.Diff), totalSize, len(gresp.Deleted))
+			return nil
 		}
 	}
 
-	//download files
-	var upCount int32
-	if len(gresp.Diff) > 0 {
-		var wg sync.WaitGroup
-		for fname, diff := range gresp.Diff {
-			wg.Add(1)
-			go func(fname string, d gsync.Diff) {
-				defer wg.Done()
-				//get diff file
-				requrl := fmt.Sprintf("http://%s/app/%s/%s", config.SyncHost, config.SyncApp, fname)
-				if config.SyncDetail {
-					log.Printf("downloading %s\n", requrl)
-				}
-				resp, err := http.Get(requrl)
-				if err != nil {
-					log.Printf("get url error:%s", err)
-					return
-				}
+	//files must be listed in the signed manifest if a public key is configed
+	var manifest *gsync.Manifest
+	if len(config.PublicKey) > 0 {
+		manifest, err = requestManifest(gresp.Release)
+		if err != nil {
+			return fmt.Errorf("update failed. verify manifest error:%v", err)
+		}
+		for _, fname := range gresp.Deleted {
+			if _, ok := manifest.Lookup(fname); ok {
+				return fmt.Errorf("update failed. deleted file %s is in manifest", fname)
+			}
+		}
+	}
 
-				fileContent, err := ioutil.ReadAll(resp.Body)
-				if err != nil {
-					log.Printf("read response error:%v", err)
-					return
-				}
+	//stage all files first, nothing is changed until every file is verified
+	tx, err := gsync.BeginTransaction(config.SyncDir)
+	if err != nil {
+		return fmt.Errorf("update failed. begin transaction error:%v", err)
+	}
+	tx.HashAlgo = req.HashAlgo
+	tx.Manifest = manifest
 
-				if resp.StatusCode != http.StatusOK {
-					log.Printf("download %s failed: statusCode=%d, response=%s",
-						fname, resp.StatusCode, fileContent)
-					return
-				}
+	//copy files which exist locally under other names
+	copies, err := tx.StageLocalCopies(gresp.Diff)
+	if err != nil {
+		tx.Abort()
+		return fmt.Errorf("update failed. copy local file error:%v", err)
+	}
+	if config.SyncDetail && len(copies) > 0 {
+		log.Printf("copied %d local files: %v\n", len(copies), copies)
+	}
+	copied := make(map[string]bool)
+	for _, fname := range copies {
+		copied[fname] = true
+	}
 
-				newHash := fmt.Sprintf("%x", md5.Sum(fileContent))
-				if newHash != d.NewHash {
-					log.Printf("file %s hash check failed. expect %s, got %s", fname, d.NewHash, newHash)
-					return
-				}
-				err = gsync.ReplaceFile(fileContent, filepath.Join(wd, fname), d.Mode, d.ModTime)
-				if err != nil {
-					log.Printf("replace file error:%v", err)
-					return
-				}
-				atomic.AddInt32(&upCount, 1)
-			}(fname, diff)
+	//request deltas of big files which already exist locally
+	sigReq := &gsync.Request{
+		ClientVersion: req.ClientVersion,
+		Release:       gresp.Release,
+		Signatures:    make(map[string]*gsync.Signature),
+	}
+	for fname, d := range gresp.Diff {
+		if d.OldHash == "" || d.NewSize < deltaMinSize || copied[fname] {
+			continue
+		}
+		sig, err := gsync.MakeFileSignature(filepath.Join(config.SyncDir, fname), gsync.DefaultBlockSize)
+		if err != nil {
+			log.Printf("make signature of %s error:%v", fname, err)
+			continue
+		}
+		sigReq.Signatures[fname] = sig
+	}
+	var deltas map[string]*gsync.Delta
+	//servers not advertising transfer modes may still calc deltas
+	if len(sigReq.Signatures) > 0 && (len(gresp.Modes) == 0 || gresp.HasMode(gsync.TransferDelta)) {
+		deltas, err = requestDeltas(sigReq)
+		if err != nil {
+			log.Printf("request deltas error:%v", err)
+		}
+	}
+
+	//download files, at most config.Downloads at the same time
+	stageCount := int32(len(copies))
+	downloads := make(chan struct{}, config.Downloads)
+	stageFile := func(fname string, d gsync.Diff) {
+		downloads <- struct{}{}
+		defer func() { <-downloads }()
+		if delta, ok := deltas[fname]; ok {
+			if config.SyncDetail {
+				log.Printf("patching %s\n", fname)
+			}
+			err := patchFile(tx, fname, delta, d)
+			if err == nil {
+				atomic.AddInt32(&stageCount, 1)
+				return
+			}
+			log.Printf("patch file error:%v, download it instead", err)
 		}
 
-		wg.Wait()
+		//get diff file
+		requrl := fmt.Sprintf("%s/app/%s/%s", serverURL(), config.SyncApp, fname)
+		if len(gresp.Release) > 0 {
+			//download from the release the diff was calculated on
+			requrl += "?release=" + url.QueryEscape(gresp.Release)
+		}
+		if config.SyncDetail {
+			log.Printf("downloading %s\n", requrl)
+		}
+		fileContent, err := downloadFile(requrl, partialName(fname, d.NewHash))
+		if err != nil {
+			log.Printf("download %s failed: %v", fname, err)
+			return
+		}
 
-		if int(upCount) == len(gresp.Diff) {
-			os.Chtimes(autoupdate, time.Now(), time.Now())
-			log.Printf("update successfully\n")
-		} else {
-			log.Printf("update failed. %d of %d was updated\n", upCount, len(gresp.Diff))
+		if err = tx.Stage(fname, fileContent, d); err != nil {
+			log.Printf("stage file error:%v", err)
+			return
 		}
-	} else {
-		log.Printf("up to date\n")
+		atomic.AddInt32(&stageCount, 1)
 	}
+
+	//many small files are downloaded in bundles, others one by one
+	pending := make(gsync.DiffMap)
+	bundleable := make(gsync.DiffMap)
+	for fname, d := range gresp.Diff {
+		if copied[fname] {
+			continue
+		}
+		pending[fname] = d
+		if _, ok := deltas[fname]; !ok {
+			bundleable[fname] = d
+		}
+	}
+	var bundles [][]string
+	if gresp.HasMode(gsync.TransferBundle) {
+		bundles = planBundles(bundleable)
+	}
+	var wg sync.WaitGroup
+	for _, files := range bundles {
+		for _, fname := range files {
+			delete(pending, fname)
+		}
+		wg.Add(1)
+		go func(files []string) {
+			defer wg.Done()
+			if config.SyncDetail {
+				log.Printf("downloading bundle of %d files\n", len(files))
+			}
+			downloads <- struct{}{}
+			err := stageBundle(tx, files, gresp.Diff, req.HashAlgo, gresp.Release)
+			//released before falling back, files take their own turns
+			<-downloads
+			if err == nil {
+				atomic.AddInt32(&stageCount, int32(len(files)))
+				return
+			}
+			log.Printf("download bundle error:%v, download files one by one", err)
+			for _, fname := range files {
+				stageFile(fname, gresp.Diff[fname])
+			}
+		}(files)
+	}
+	for fname, d := range pending {
+		wg.Add(1)
+		go func(fname string, d gsync.Diff) {
+			defer wg.Done()
+			stageFile(fname, d)
+		}(fname, d)
+	}
+	wg.Wait()
+
+	if int(stageCount) != len(gresp.Diff) {
+		tx.Abort()
+		return fmt.Errorf("update failed. %d of %d was downloaded", stageCount, len(gresp.Diff))
+	}
+
+	//apply all files together
+	tx.Remove(gresp.Deleted, config.Ignore)
+	updates, err := tx.Commit(config.KeepBackups)
+	if config.SyncDetail {
+		log.Printf("updated %d files: %v\n", len(updates), updates)
+	}
+	if err != nil {
+		return fmt.Errorf("update interrupted, it will be completed on next run. error:%v", err)
+	}
+
+	os.RemoveAll(partialDir())
+	os.Chtimes(autoupdate, time.Now(), time.Now())
+	log.Printf("update successfully\n")
+	return nil
 }
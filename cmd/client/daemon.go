@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gsync"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+//check update interval of daemon if not configed
+const defaultInterval = 10 * time.Minute
+
+//runDaemon checks update periodically until SIGTERM or interrupt is received.
+//requests of a running update are aborted on exit, files are only changed once all are downloaded
+func runDaemon() {
+	interval := defaultInterval
+	if len(config.Interval) > 0 {
+		d, err := time.ParseDuration(config.Interval)
+		if err != nil || d <= 0 {
+			log.Fatalf("invalid interval:%s", config.Interval)
+		}
+		interval = d
+	}
+
+	stopc := make(chan os.Signal, 1)
+	signal.Notify(stopc, syscall.SIGTERM, os.Interrupt)
+	ctx, cancel := context.WithCancel(context.Background())
+	requestCtx = ctx
+	go func() {
+		sig := <-stopc
+		log.Printf("received %v, daemon exit\n", sig)
+		cancel()
+	}()
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	notifyc := make(chan struct{}, 1)
+	go watchApp(notifyc)
+	log.Printf("daemon started, check update every %v\n", interval)
+	for {
+		if err := syncApp(); err != nil && ctx.Err() == nil {
+			log.Println(err)
+		}
+
+		//add up to 10% jitter, so clients don't poll the server at the same time
+		wait := interval + time.Duration(rnd.Int63n(int64(interval)/10+1))
+		select {
+		case <-ctx.Done():
+			return
+		case <-notifyc:
+			if config.SyncDetail {
+				log.Printf("app changed on server\n")
+			}
+		case <-time.After(wait):
+		}
+	}
+}
+
+//watchApp long-polls the server and signals notifyc when app files changed.
+//it returns if the server doesn't support watching, leaving daemon polling only
+func watchApp(notifyc chan<- struct{}) {
+	var since int64
+	var failures int
+	for {
+		if failures > 0 {
+			//back off up to a minute while server is unreachable or the app is not found
+			if failures > 60 {
+				failures = 60
+			}
+			select {
+			case <-requestCtx.Done():
+				return
+			case <-time.After(time.Duration(failures) * time.Second):
+			}
+		}
+		requrl := fmt.Sprintf("%s/watch/%s?since=%d", serverURL(), config.SyncApp, since)
+		resp, err := httpGet(requrl)
+		if err != nil {
+			if requestCtx.Err() != nil {
+				return
+			}
+			failures++
+			continue
+		}
+		content, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusMethodNotAllowed {
+			log.Printf("server doesn't support watching app, check update every interval only\n")
+			return
+		}
+		var wresp gsync.WatchResponse
+		if err != nil || resp.StatusCode != http.StatusOK || json.Unmarshal(content, &wresp) != nil {
+			//the app may be removed or not configed yet, and old servers don't know watching
+			if resp.StatusCode == http.StatusNotFound && failures == 0 {
+				log.Printf("watch app error: app not found, retry later\n")
+			}
+			failures++
+			continue
+		}
+		failures = 0
+		if wresp.Changed {
+			select {
+			case notifyc <- struct{}{}:
+			default:
+			}
+		}
+		since = wresp.Version
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"gsync"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//download retries if not configed
+const defaultRetries = 3
+
+//concurrent downloads if not configed
+const defaultDownloads = 4
+
+//partInfo describes a partial download kept in the state dir
+type partInfo struct {
+	ETag     string
+	Encoding string
+}
+
+func partialDir() string {
+	return filepath.Join(config.SyncDir, gsync.StateDir, "partial")
+}
+
+//partialName names the partial download of file fname with hash, files of the same content download apart
+func partialName(fname string, hash string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(fname+"\x00"+hash)))
+}
+
+//errNotFound is returned if the file to download is not on the server, it is not retried
+var errNotFound = fmt.Errorf("file not found on server")
+
+//downloadFile downloads requrl, resuming the partial download named name if any.
+//it retries on failures and returns the decoded content
+func downloadFile(requrl string, name string) ([]byte, error) {
+	rc, err := openDownload(requrl, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+//openDownload downloads requrl like downloadFile, and returns a reader decoding the downloaded file.
+//the file is removed when the reader is closed
+func openDownload(requrl string, name string) (io.ReadCloser, error) {
+	var err error
+	for i := 0; i <= config.Retries; i++ {
+		if i > 0 {
+			log.Printf("download %s error:%v, retry %d", requrl, err, i)
+			select {
+			case <-requestCtx.Done():
+				return nil, requestCtx.Err()
+			case <-time.After(time.Duration(i) * time.Second):
+			}
+		}
+		var rc io.ReadCloser
+		if rc, err = downloadPart(requrl, name); err == nil || err == errNotFound {
+			return rc, err
+		}
+	}
+	return nil, err
+}
+
+//partReader decodes a completed download, and removes it on Close
+type partReader struct {
+	io.ReadCloser
+	fr       *os.File
+	partfile string
+	infofile string
+}
+
+func (r *partReader) Close() error {
+	r.ReadCloser.Close()
+	err := r.fr.Close()
+	os.Remove(r.partfile)
+	os.Remove(r.infofile)
+	return err
+}
+
+func downloadPart(requrl string, name string) (io.ReadCloser, error) {
+	partfile := filepath.Join(partialDir(), name+".part")
+	infofile := filepath.Join(partialDir(), name+".json")
+	if err := os.MkdirAll(partialDir(), 0777); err != nil {
+		return nil, err
+	}
+
+	var info partInfo
+	var offset int64
+	if content, err := ioutil.ReadFile(infofile); err == nil && json.Unmarshal(content, &info) == nil {
+		if fi, err := os.Stat(partfile); err == nil {
+			offset = fi.Size()
+		}
+	}
+
+	httpReq, err := http.NewRequest("GET", requrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	//ask for the encoding explicitly, so ranges are on the encoded content we keep
+	httpReq.Header.Set("Accept-Encoding", acceptEncoding())
+	if offset > 0 && len(info.ETag) > 0 {
+		httpReq.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		httpReq.Header.Set("If-Range", info.ETag)
+	}
+	resp, err := doRequest(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		flag = os.O_WRONLY | os.O_APPEND
+		if config.SyncDetail {
+			log.Printf("resume %s from %d\n", requrl, offset)
+		}
+	case http.StatusOK:
+		info = partInfo{
+			ETag:     resp.Header.Get("ETag"),
+			Encoding: resp.Header.Get("Content-Encoding"),
+		}
+		content, _ := json.Marshal(info)
+		if err = ioutil.WriteFile(infofile, content, 0666); err != nil {
+			return nil, err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		os.Remove(partfile)
+		os.Remove(infofile)
+		return nil, fmt.Errorf("range not satisfiable")
+	case http.StatusNotFound:
+		os.Remove(partfile)
+		os.Remove(infofile)
+		return nil, errNotFound
+	default:
+		content, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("statusCode=%d, response=%s", resp.StatusCode, content)
+	}
+
+	fw, err := os.OpenFile(partfile, flag, 0666)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(fw, resp.Body)
+	fw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	//download completed, it is decoded from the file, never held in memory as a whole
+	fr, err := os.Open(partfile)
+	if err != nil {
+		return nil, err
+	}
+	codec := gsync.CodecNone
+	if len(info.Encoding) > 0 && info.Encoding != "identity" {
+		codec = info.Encoding
+	}
+	cr, err := gsync.NewCodecReader(fr, codec)
+	if err != nil {
+		fr.Close()
+		os.Remove(partfile)
+		os.Remove(infofile)
+		return nil, err
+	}
+	return &partReader{ReadCloser: cr, fr: fr, partfile: partfile, infofile: infofile}, nil
+}
+
+//acceptEncoding returns Accept-Encoding of downloads for the configed codec
+func acceptEncoding() string {
+	switch config.Codec {
+	case gsync.CodecZstd:
+		//old servers only compress with gzip
+		return "zstd, gzip"
+	case gsync.CodecNone:
+		return "identity"
+	}
+	return "gzip"
+}
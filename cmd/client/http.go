@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	//dialTimeout limits connecting to the sync server and tls handshakes
+	dialTimeout = 30 * time.Second
+	//readTimeout is the longest the server may send nothing, longer than long polls of /watch
+	readTimeout = 2 * time.Minute
+)
+
+var httpClient = http.DefaultClient
+
+//requestCtx aborts requests in flight when it is cancelled, such as on exit of daemon
+var requestCtx = context.Background()
+
+//timeoutConn fails reads if nothing is received for readTimeout, so stalled connections never block syncs
+type timeoutConn struct {
+	net.Conn
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(readTimeout))
+	return c.Conn.Read(b)
+}
+
+//requestEncoding is the content coding of json request bodies.
+//requests are sent in form fields until the server tells it accepts json
+var requestEncoding string
+
+//serverURL returns scheme and host of the sync server
+func serverURL() string {
+	if config.HTTPS {
+		return "https://" + config.SyncHost
+	}
+	return "http://" + config.SyncHost
+}
+
+func configPath(p string) string {
+	if len(p) == 0 || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(wd, p)
+}
+
+//setupHTTPClient configures timeouts and tls of requests to the sync server
+func setupHTTPClient() error {
+	dialer := &net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &timeoutConn{Conn: conn}, nil
+	}
+	transport.TLSHandshakeTimeout = dialTimeout
+	transport.ResponseHeaderTimeout = readTimeout
+	httpClient = &http.Client{Transport: transport}
+	if !config.HTTPS {
+		return nil
+	}
+	tlsConfig := &tls.Config{}
+	if len(config.CACert) > 0 {
+		pem, err := ioutil.ReadFile(configPath(config.CACert))
+		if err != nil {
+			return err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in %s", config.CACert)
+		}
+	}
+	if len(config.ClientCert) > 0 {
+		cert, err := tls.LoadX509KeyPair(configPath(config.ClientCert), configPath(config.ClientKey))
+		if err != nil {
+			return err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if len(config.CertFingerprint) > 0 {
+		fingerprint, err := hex.DecodeString(strings.Replace(config.CertFingerprint, ":", "", -1))
+		if err != nil {
+			return fmt.Errorf("invalid certificate fingerprint:%v", err)
+		}
+		//a pinned certificate needn't be signed by a trusted ca
+		tlsConfig.InsecureSkipVerify = len(config.CACert) == 0
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("no server certificate")
+			}
+			sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+			if !bytes.Equal(sum[:], fingerprint) {
+				return fmt.Errorf("server certificate fingerprint %x not match", sum)
+			}
+			return nil
+		}
+	}
+	transport.TLSClientConfig = tlsConfig
+	return nil
+}
+
+//doRequest sends httpReq to the sync server with the token of the client
+func doRequest(httpReq *http.Request) (*http.Response, error) {
+	if len(config.Token) > 0 {
+		httpReq.Header.Set("Authorization", "Bearer "+config.Token)
+	}
+	return httpClient.Do(httpReq.WithContext(requestCtx))
+}
+
+//httpGet is http.Get sending the token of the client
+func httpGet(requrl string) (*http.Response, error) {
+	httpReq, err := http.NewRequest("GET", requrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	return doRequest(httpReq)
+}
+
+//postForm is http.PostForm sending the token of the client
+func postForm(requrl string, values url.Values) (*http.Response, error) {
+	httpReq, err := http.NewRequest("POST", requrl, strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return doRequest(httpReq)
+}
+
+//postRequest posts v to the server, in a compressed json body if the server accepts it
+func postRequest(requrl string, v interface{}) (*http.Response, error) {
+	if len(requestEncoding) == 0 {
+		content, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := postForm(requrl, url.Values{"req": {string(content)}})
+		if err == nil {
+			requestEncoding = acceptedEncoding(resp.Header.Get("Accept-Encoding"))
+		}
+		return resp, err
+	}
+
+	//encode while sending, the request is never held in memory as a whole
+	encoding := requestEncoding
+	newBody := func() (io.ReadCloser, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(encodeRequest(pw, encoding, v))
+		}()
+		return pr, nil
+	}
+	body, _ := newBody()
+	httpReq, err := http.NewRequest("POST", requrl, body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	//the body is encoded again if the request is retried on another connection.
+	//requests only query the server, so they are marked idempotent to be retried at all
+	httpReq.GetBody = newBody
+	httpReq.Header.Set("Idempotency-Key", "")
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Content-Encoding", encoding)
+	resp, err := doRequest(httpReq)
+	if err == nil && resp.StatusCode >= 400 &&
+		(resp.StatusCode == http.StatusUnsupportedMediaType || len(resp.Header.Get("Accept-Encoding")) == 0) {
+		//server was replaced by an older one, which reads json as an empty form, send forms again
+		resp.Body.Close()
+		requestEncoding = ""
+		return postRequest(requrl, v)
+	}
+	return resp, err
+}
+
+//acceptedEncoding picks the request encoding from Accept-Encoding of a response
+func acceptedEncoding(accept string) string {
+	var encoding string
+	for _, e := range strings.Split(accept, ",") {
+		switch strings.TrimSpace(e) {
+		case "zstd":
+			return "zstd"
+		case "gzip":
+			encoding = "gzip"
+		}
+	}
+	return encoding
+}
+
+func encodeRequest(w io.Writer, encoding string, v interface{}) error {
+	var cw io.WriteCloser
+	var err error
+	switch encoding {
+	case "zstd":
+		cw, err = zstd.NewWriter(w)
+	case "gzip":
+		cw = gzip.NewWriter(w)
+	default:
+		return fmt.Errorf("unsupported content encoding %s", encoding)
+	}
+	if err != nil {
+		return err
+	}
+	if err = json.NewEncoder(cw).Encode(v); err != nil {
+		cw.Close()
+		return err
+	}
+	return cw.Close()
+}
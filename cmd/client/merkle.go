@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gsync"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+//apps with fewer files send all hashes instead of walking merkle trees
+const merkleWalkMinFiles = 1000
+
+//requestTree gets children of dirs in the merkle tree of the server
+func requestTree(req *gsync.TreeRequest) (*gsync.TreeResponse, error) {
+	requrl := fmt.Sprintf("%s/tree/%s", serverURL(), config.SyncApp)
+	resp, err := postRequest(requrl, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("statusCode=%d, response=%s", resp.StatusCode, content)
+	}
+	var tresp gsync.TreeResponse
+	if err = json.Unmarshal(content, &tresp); err != nil {
+		return nil, err
+	}
+	return &tresp, nil
+}
+
+//walkTree compares the local merkle tree with the server's top down, descending only
+//into dirs which differ. it returns the paths which differ
+func walkTree(local *gsync.MerkleTree, algo string, release string) ([]string, error) {
+	var scope []string
+	dirs := []string{""}
+	for len(dirs) > 0 {
+		tresp, err := requestTree(&gsync.TreeRequest{HashAlgo: algo, Release: release, Dirs: dirs})
+		if err != nil {
+			return nil, err
+		}
+		if tresp.Release != release {
+			return nil, fmt.Errorf("release changed from %s to %s", release, tresp.Release)
+		}
+		var next []string
+		for _, dir := range dirs {
+			descend, paths := local.Compare(dir, tresp.Dirs[dir])
+			next = append(next, descend...)
+			scope = append(scope, paths...)
+		}
+		dirs = next
+	}
+	if len(scope) == 0 {
+		//roots differed but dirs are equal, files were changed while walking
+		return nil, fmt.Errorf("no differing paths found")
+	}
+	if config.SyncDetail {
+		log.Printf("differing paths: %v\n", scope)
+	}
+	return scope, nil
+}
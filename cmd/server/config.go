@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gsync"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+//config.txt is reloaded after it was not written for configReloadDelay
+const configReloadDelay = 500 * time.Millisecond
+
+//configMu guards config.Apps, which is swapped on reload
+var configMu sync.RWMutex
+
+func configPath() string {
+	return filepath.Join(wd, "config.txt")
+}
+
+//loadConfig reads and validates config.txt
+func loadConfig() (*Config, error) {
+	content, err := ioutil.ReadFile(configPath())
+	if err != nil {
+		return nil, err
+	}
+	c := new(Config)
+	if err = json.Unmarshal(content, c); err != nil {
+		return nil, err
+	}
+	for appName, app := range c.Apps {
+		if app == nil || len(app.AppDir) == 0 {
+			return nil, fmt.Errorf("dir of app %s was not configed", appName)
+		}
+		if !filepath.IsAbs(app.AppDir) {
+			app.AppDir = filepath.Join(wd, app.AppDir)
+		}
+		if err = loadSigningKey(app); err != nil {
+			return nil, fmt.Errorf("load signing key of %s error:%v", appName, err)
+		}
+	}
+	return c, nil
+}
+
+func readConfig() {
+	c, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	config = *c
+}
+
+//getApp returns the config of app
+func getApp(appName string) (*AppConfig, bool) {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	app, ok := config.Apps[appName]
+	return app, ok
+}
+
+//getApps returns configs of all apps
+func getApps() map[string]*AppConfig {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return config.Apps
+}
+
+//reloadConfig swaps apps with the ones of config.txt, and watches dirs of added apps.
+//the old config is kept if the new one is invalid
+func reloadConfig() error {
+	c, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	configMu.Lock()
+	oldApps := config.Apps
+	//listening and the patch cache are set up once
+	restart := *c
+	restart.Apps = config.Apps
+	if !reflect.DeepEqual(restart, config) {
+		log.Printf("changes of listen, tls and cache settings take effect after restart")
+	}
+	config.Apps = c.Apps
+	configMu.Unlock()
+
+	var oldDirs, dirs []string
+	for _, app := range oldApps {
+		oldDirs = append(oldDirs, app.AppDir)
+	}
+	for _, app := range c.Apps {
+		dirs = append(dirs, app.AppDir)
+	}
+	//dirs not existing when they were configed are watched once they exist
+	added, unwatched := gsync.DiffDirs(getWatchedDirs(), dirs)
+	for _, dir := range added {
+		//trees built while the dir was not watched may be stale
+		dropTrees(dir, getWatchedDirs())
+		if err := watchApp(dir); err != nil {
+			log.Printf("watch dir %s error:%v", dir, err)
+		}
+	}
+	//dirs of remaining apps may be nested in removed ones or contain them
+	for _, dir := range unwatched {
+		unwatchApp(dir, dirs)
+	}
+	_, removed := gsync.DiffDirs(oldDirs, dirs)
+	for _, dir := range removed {
+		dropTrees(dir, dirs)
+		dropManifests(dir)
+	}
+	if len(removed) > 0 {
+		//files of removed dirs are not updated any more
+		appCache.Clear()
+	}
+	for appName, app := range oldApps {
+		if newApp, ok := c.Apps[appName]; !ok || newApp.AppDir != app.AppDir {
+			//clients watching removed apps get not found next, the ones of moved apps sync
+			dropNotifier(appName)
+		}
+	}
+	log.Printf("config reloaded, %d apps", len(c.Apps))
+	return nil
+}
+
+//watchConfig reloads config.txt when it is changed or on SIGHUP
+func watchConfig() {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP)
+
+	//the dir is watched, as editors may replace the file
+	var events chan fsnotify.Event
+	var errors chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		if err = watcher.Add(wd); err == nil {
+			events, errors = watcher.Events, watcher.Errors
+			defer watcher.Close()
+		}
+	}
+	if err != nil {
+		log.Printf("watch config error:%v, reload it by SIGHUP", err)
+	}
+
+	var delay <-chan time.Time
+	for {
+		select {
+		case <-sigc:
+			delay = time.After(0)
+		case event := <-events:
+			if filepath.Clean(event.Name) == configPath() {
+				delay = time.After(configReloadDelay)
+			}
+		case err := <-errors:
+			log.Println("watch config error:", err)
+		case <-delay:
+			delay = nil
+			if err := reloadConfig(); err != nil {
+				log.Printf("reload config error:%v, keep the old one", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_LoadConfig(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "gsync.")
+	defer os.RemoveAll(dir)
+	oldwd := wd
+	wd = dir
+	defer func() { wd = oldwd }()
+
+	write := func(content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, "config.txt"), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"listen":":8088","apps":{"a":{"dir":"publish/a"},"b":{"dir":"/srv/b","tokens":["t"]}}}`)
+	c, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Apps["a"].AppDir != filepath.Join(dir, "publish/a") || c.Apps["b"].AppDir != "/srv/b" {
+		t.Fatalf("unexpected app dirs %s %s", c.Apps["a"].AppDir, c.Apps["b"].AppDir)
+	}
+
+	//invalid configs are rejected, so reloads keep the old one
+	for _, content := range []string{
+		`{"apps":{"a":{}}}`,
+		`{"apps":{"a":null}}`,
+		`{"apps":{"a":{"dir":"a","signingkey":"missing.key"}}}`,
+		`{"apps":`,
+	} {
+		write(content)
+		if _, err = loadConfig(); err == nil {
+			t.Errorf("expect config %s invalid", content)
+		}
+	}
+}
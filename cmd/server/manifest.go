@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"gsync"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	//signed manifests by dir, dropped when files in dir change
+	manifests   = make(map[string]*gsync.SignedManifest)
+	manifestsMu sync.Mutex
+)
+
+//loadSigningKey reads the signing key of app
+func loadSigningKey(app *AppConfig) error {
+	if len(app.SigningKey) == 0 {
+		return nil
+	}
+	fpath := app.SigningKey
+	if !filepath.IsAbs(fpath) {
+		fpath = filepath.Join(wd, fpath)
+	}
+	content, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return err
+	}
+	app.signingKey, err = gsync.ParsePrivateKey(string(content))
+	return err
+}
+
+//signedManifest returns the manifest of release dir signed with key
+func signedManifest(appName string, release string, dir string, key ed25519.PrivateKey) (*gsync.SignedManifest, error) {
+	manifestsMu.Lock()
+	defer manifestsMu.Unlock()
+	if sm, ok := manifests[dir]; ok {
+		return sm, nil
+	}
+	tree, err := getTree(dir)
+	if err != nil {
+		return nil, err
+	}
+	sm, err := tree.Manifest(appName, release).Sign(key)
+	if err != nil {
+		return nil, err
+	}
+	manifests[dir] = sm
+	return sm, nil
+}
+
+//dropAllManifests forgets all manifests
+func dropAllManifests() {
+	manifestsMu.Lock()
+	defer manifestsMu.Unlock()
+	manifests = make(map[string]*gsync.SignedManifest)
+}
+
+//dropManifests forgets manifests of dirs containing fp
+func dropManifests(fp string) {
+	manifestsMu.Lock()
+	defer manifestsMu.Unlock()
+	for dir := range manifests {
+		if fp == dir || strings.HasPrefix(fp, dir+string(filepath.Separator)) {
+			delete(manifests, dir)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"gsync"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//appNotifier wakes up clients watching an app when its files change
+type appNotifier struct {
+	sync.Mutex
+	version int64
+	changed chan struct{}
+}
+
+var (
+	notifiers   map[string]*appNotifier
+	notifiersMu sync.Mutex
+)
+
+func newAppNotifier() *appNotifier {
+	return &appNotifier{
+		//versions of a restarted server never match old ones
+		version: time.Now().UnixNano(),
+		changed: make(chan struct{}),
+	}
+}
+
+func (n *appNotifier) notify() {
+	n.Lock()
+	defer n.Unlock()
+	n.version++
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+func (n *appNotifier) current() int64 {
+	n.Lock()
+	defer n.Unlock()
+	return n.version
+}
+
+//wait blocks until version differs from since or timeout. it returns the current version
+func (n *appNotifier) wait(since int64, timeout time.Duration) int64 {
+	n.Lock()
+	if n.version != since {
+		defer n.Unlock()
+		return n.version
+	}
+	changed := n.changed
+	n.Unlock()
+
+	select {
+	case <-changed:
+	case <-time.After(timeout):
+	}
+	n.Lock()
+	defer n.Unlock()
+	return n.version
+}
+
+func getNotifier(appName string) *appNotifier {
+	notifiersMu.Lock()
+	defer notifiersMu.Unlock()
+	n, ok := notifiers[appName]
+	if !ok {
+		n = newAppNotifier()
+		notifiers[appName] = n
+	}
+	return n
+}
+
+//dropNotifier wakes up clients watching a removed app and forgets its notifier
+func dropNotifier(appName string) {
+	notifiersMu.Lock()
+	n, ok := notifiers[appName]
+	delete(notifiers, appName)
+	notifiersMu.Unlock()
+	if ok {
+		n.notify()
+	}
+}
+
+//notifyFileEvent notifies watchers of apps the changed file belongs to, apps may be nested
+func notifyFileEvent(fp string) {
+	fp = filepath.Clean(fp)
+	for appName, app := range getApps() {
+		appDir := filepath.Clean(app.AppDir)
+		if !strings.HasPrefix(fp, appDir+string(filepath.Separator)) {
+			continue
+		}
+		//apps using releases change only when current is switched
+		current := filepath.Join(appDir, gsync.CurrentFile)
+		if _, err := os.Stat(current); err == nil && fp != current {
+			continue
+		}
+		getNotifier(appName).notify()
+	}
+}
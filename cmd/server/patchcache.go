@@ -0,0 +1,71 @@
+package main
+
+import (
+	"gsync"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//transfer modes advertised to clients
+var transferModes = []string{gsync.TransferFile, gsync.TransferBundle, gsync.TransferDelta}
+
+//how often patches over the max age are removed
+const patchEvictPeriod = time.Minute
+
+//patches of old clients are kept for patchPinPeriod after responses, they have no fallback if a patch is gone
+const patchPinPeriod = 10 * time.Minute
+
+//patchCache limits size and age of patch files in CacheDir
+var patchCache *gsync.DiskCache
+
+//startPatchCache loads patch files already in CacheDir and removes expired ones periodically
+func startPatchCache() error {
+	var maxAge time.Duration
+	if len(config.CacheMaxAge) > 0 {
+		var err error
+		if maxAge, err = time.ParseDuration(config.CacheMaxAge); err != nil {
+			return err
+		}
+	}
+	patchCache = gsync.NewDiskCache(config.CacheDir, config.CacheMaxMB<<20, maxAge)
+	patchCache.Companion = gsync.PatchManifestPath
+	if err := patchCache.Load(); err != nil {
+		return err
+	}
+	go func() {
+		for range time.Tick(patchEvictPeriod) {
+			for _, fpath := range patchCache.Evict() {
+				log.Printf("evict patch %s", fpath)
+			}
+		}
+	}()
+	return nil
+}
+
+//preparePatch writes files of diff in dir into a patch of app, and returns its url path and size.
+//the patch is kept until release is called
+func preparePatch(appName string, app *AppConfig, dir string, diff gsync.DiffMap, codec string) (string, int64, func(), error) {
+	//patches are kept per app, so they are served to authorized clients only
+	cacheDir := filepath.Join(config.CacheDir, appName)
+	for retry := 0; ; retry++ {
+		fname, err := gsync.PrepareDiffWithOptions(dir, cacheDir, diff, gsync.PatchOptions{
+			App:        appName,
+			Codec:      codec,
+			NoCompress: app.NoCompress,
+		})
+		if err != nil {
+			return "", 0, nil, err
+		}
+		size, release, err := patchCache.AddAndAcquire(fname)
+		//a cached patch may be evicted before it is pinned, it is built again then
+		if os.IsNotExist(err) && retry == 0 {
+			continue
+		}
+		if err != nil {
+			return "", 0, nil, err
+		}
+		return "/tmpfiles/" + appName + "/" + filepath.Base(fname), size, release, nil
+	}
+}
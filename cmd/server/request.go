@@ -0,0 +1,60 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+//content codings of request bodies the server accepts, sent as Accept-Encoding of responses
+const requestEncodings = "zstd, gzip"
+
+//longest decoded request body
+const maxRequestSize = 256 << 20
+
+//readRequest decodes the request of a POST into v. it is a json body, which may be compressed,
+//or the form field req sent by old clients
+func readRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	w.Header().Set("Accept-Encoding", requestEncodings)
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		r.ParseForm()
+		if err := json.Unmarshal([]byte(r.FormValue("req")), v); err != nil {
+			http.Error(w, "invalid request", 400)
+			return false
+		}
+		return true
+	}
+
+	var body io.Reader = r.Body
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		gr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, "invalid request", 400)
+			return false
+		}
+		defer gr.Close()
+		body = gr
+	case "zstd":
+		zr, err := zstd.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, "invalid request", 400)
+			return false
+		}
+		defer zr.Close()
+		body = zr
+	default:
+		http.Error(w, "unsupported content encoding", http.StatusUnsupportedMediaType)
+		return false
+	}
+	if err := json.NewDecoder(io.LimitReader(body, maxRequestSize)).Decode(v); err != nil {
+		http.Error(w, "invalid request", 400)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type testRequest struct {
+	App   string
+	Files []string
+}
+
+func Test_ReadRequest(t *testing.T) {
+	content := `{"App":"app","Files":["a","b/c"]}`
+	var gz, zs bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write([]byte(content))
+	gw.Close()
+	zw, _ := zstd.NewWriter(&zs)
+	zw.Write([]byte(content))
+	zw.Close()
+
+	cases := []struct {
+		name        string
+		contentType string
+		encoding    string
+		body        string
+		code        int
+	}{
+		{"identity", "application/json", "", content, 200},
+		{"identity", "application/json", "identity", content, 200},
+		{"gzip", "application/json", "gzip", gz.String(), 200},
+		{"zstd", "application/json", "zstd", zs.String(), 200},
+		{"form", "application/x-www-form-urlencoded", "", url.Values{"req": {content}}.Encode(), 200},
+		{"unknown encoding", "application/json", "br", content, http.StatusUnsupportedMediaType},
+		{"invalid gzip", "application/json", "gzip", content, 400},
+		{"invalid json", "application/json", "", "{", 400},
+		{"invalid form", "application/x-www-form-urlencoded", "", "req=", 400},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", "/hasupdate", strings.NewReader(c.body))
+		r.Header.Set("Content-Type", c.contentType)
+		if len(c.encoding) > 0 {
+			r.Header.Set("Content-Encoding", c.encoding)
+		}
+		w := httptest.NewRecorder()
+		var req testRequest
+		ok := readRequest(w, r, &req)
+		if ok != (c.code == 200) || w.Code != c.code {
+			t.Errorf("%s: ok %v code %d, expect %d", c.name, ok, w.Code, c.code)
+			continue
+		}
+		if w.Header().Get("Accept-Encoding") != requestEncodings {
+			t.Errorf("%s: Accept-Encoding %q", c.name, w.Header().Get("Accept-Encoding"))
+		}
+		if ok && (req.App != "app" || len(req.Files) != 2 || req.Files[1] != "b/c") {
+			t.Errorf("%s: decoded %+v", c.name, req)
+		}
+	}
+}
@@ -2,9 +2,13 @@ package main
 
 import (
 	"bytes"
-	"compress/gzip"
-	"crypto/md5"
+	"crypto/ed25519"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"gsync"
 	"io"
@@ -13,6 +17,8 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -24,89 +30,273 @@ import (
 type Config struct {
 	Listen   string
 	CacheDir string
-	Apps     map[string]*struct {
-		AppDir string `json:"dir"`
-	}
+	//CacheMaxMB limits the size of patches in CacheDir, least recently downloaded ones are removed first
+	CacheMaxMB int64 `json:"cachemaxmb"`
+	//CacheMaxAge removes patches not downloaded for the duration, such as "72h"
+	CacheMaxAge string `json:"cachemaxage"`
+	//TLSCert and TLSKey enable https
+	TLSCert string `json:"tlscert"`
+	TLSKey  string `json:"tlskey"`
+	//ClientCA requires clients to present certificates signed by it
+	ClientCA string `json:"clientca"`
+	Apps     map[string]*AppConfig
 }
 
+type AppConfig struct {
+	AppDir string `json:"dir"`
+	//KeepReleases limits the number of releases kept on publish
+	KeepReleases int `json:"keepreleases"`
+	//Tokens are bearer tokens allowed to access the app. app is public if empty
+	Tokens []string `json:"tokens"`
+	//SigningKey is a file of the base64 ed25519 key which signs manifests of the app
+	SigningKey string `json:"signingkey"`
+	//NoCompress lists extensions of files served and patched without compressing,
+	//gsync.DefaultNoCompress if empty. files are also sniffed by content
+	NoCompress []string `json:"nocompress"`
+
+	signingKey ed25519.PrivateKey
+}
+
+//longest time a /watch request waits for changes
+const defaultWatchTimeout = 60 * time.Second
+
 var (
 	wd         string
 	config     Config
 	appCache   *gsync.HotCache
 	appCacheMu sync.Mutex
-
-	fileHashMap   map[string]string
-	fileHashMapMu sync.Mutex
 )
 
-func watchApps(apps []string, stopc <-chan struct{}, eventc chan fsnotify.Event) {
+//appWatcher watches dirs of all apps
+var appWatcher *fsnotify.Watcher
+
+//startWatcher starts watching file events of app dirs, which are sent to eventc
+func startWatcher(eventc chan fsnotify.Event) error {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer watcher.Close()
+	appWatcher = watcher
 	go func() {
 		for {
 			select {
 			case event := <-watcher.Events:
 				//log.Printf("event2: %s", event)
+				if (event.Op & fsnotify.Create) == fsnotify.Create {
+					//watch dirs created after startup too
+					if fi, err := os.Stat(event.Name); err == nil && fi.IsDir() {
+						watchDir(watcher, event.Name)
+					}
+				}
 				eventc <- event
 			case err := <-watcher.Errors:
 				log.Println("error:", err)
+				//events may be lost, such as on fsnotify.ErrEventOverflow
+				resyncApps()
 			}
 		}
 	}()
+	return nil
+}
 
-	for _, appFolder := range apps {
-		err = watcher.Add(appFolder)
-		if err != nil {
-			log.Fatal(err)
+//watchedDirs are app dirs being watched
+var (
+	watchedDirs   = make(map[string]bool)
+	watchedDirsMu sync.Mutex
+)
+
+//getWatchedDirs returns app dirs being watched
+func getWatchedDirs() []string {
+	watchedDirsMu.Lock()
+	defer watchedDirsMu.Unlock()
+	dirs := make([]string, 0, len(watchedDirs))
+	for dir := range watchedDirs {
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+//watchApp watches dir of an app and its sub dirs, dirs not existing are skipped
+func watchApp(dir string) error {
+	if _, err := os.Stat(dir); err != nil && !os.IsExist(err) {
+		return nil
+	}
+	log.Printf("watch dir:%s", dir)
+	if err := appWatcher.Add(dir); err != nil {
+		return err
+	}
+	watchDir(appWatcher, dir)
+	watchedDirsMu.Lock()
+	watchedDirs[filepath.Clean(dir)] = true
+	watchedDirsMu.Unlock()
+	return nil
+}
+
+//unwatchApp stops watching dir of an app and its sub dirs, except the ones in or under keep
+func unwatchApp(dir string, keep []string) {
+	log.Printf("unwatch dir:%s", dir)
+	watchedDirsMu.Lock()
+	delete(watchedDirs, filepath.Clean(dir))
+	watchedDirsMu.Unlock()
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && !gsync.InDirs(path, keep) {
+			appWatcher.Remove(path)
 		}
-		filepath.Walk(appFolder, func(path string, info os.FileInfo, err error) error {
-			if info.IsDir() {
-				//log.Printf("watch dir:%s", path)
-				watcher.Add(path)
-			}
-			return nil
-		})
+		return nil
+	})
+}
+
+//watchDir adds dir and all its sub dirs to watcher
+func watchDir(watcher *fsnotify.Watcher, dir string) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			//log.Printf("watch dir:%s", path)
+			watcher.Add(path)
+		}
+		return nil
+	})
+}
+
+//resyncApps drops everything kept up to date by file events. trees are scanned again on next use,
+//and clients watching apps check for updates
+func resyncApps() {
+	dropAllTrees()
+	dropAllManifests()
+	appCache.Clear()
+	for appName := range getApps() {
+		getNotifier(appName).notify()
 	}
-	<-stopc
 }
 
+//maxEventHandlers limits files hashed on file events at the same time
+var maxEventHandlers = runtime.NumCPU()
+
+var (
+	//handlingEvents holds files whose events are being handled, with the next event queued if any
+	handlingEvents   = make(map[string]*fsnotify.Event)
+	handlingEventsMu sync.Mutex
+	eventHandlers    = make(chan struct{}, maxEventHandlers)
+)
+
 func watchFileEvents(c <-chan fsnotify.Event) {
-	for {
-		select {
-		case event, ok := <-c:
-			if ok {
-				log.Printf("event: %s", event)
-				if (event.Op & fsnotify.Write) == fsnotify.Write {
-					if _, ok := appCache.Get(event.Name); ok {
-						//cal hash and cache new file content if file was written
-						hashAndCacheFile(event.Name)
-					}
-				}
+	for event := range c {
+		log.Printf("event: %s", event)
+		dispatchFileEvent(event)
+	}
+}
 
-				if (event.Op&fsnotify.Rename) == fsnotify.Rename || (event.Op&fsnotify.Remove) == fsnotify.Remove {
-					//delete file cache if it was renamed or removed
-					appCache.Delete(event.Name)
-					delete(fileHashMap, event.Name)
-				}
+//dispatchFileEvent handles event in the background, so hashing never blocks the watcher.
+//events of a file are handled in order, the ones arriving meanwhile are merged
+func dispatchFileEvent(event fsnotify.Event) {
+	handlingEventsMu.Lock()
+	if next, ok := handlingEvents[event.Name]; ok {
+		if next != nil {
+			event.Op |= next.Op
+		}
+		handlingEvents[event.Name] = &event
+		handlingEventsMu.Unlock()
+		return
+	}
+	handlingEvents[event.Name] = nil
+	handlingEventsMu.Unlock()
+
+	go func() {
+		for {
+			eventHandlers <- struct{}{}
+			handleFileEvent(event)
+			<-eventHandlers
+
+			handlingEventsMu.Lock()
+			next := handlingEvents[event.Name]
+			if next == nil {
+				delete(handlingEvents, event.Name)
+				handlingEventsMu.Unlock()
+				return
 			}
+			handlingEvents[event.Name] = nil
+			handlingEventsMu.Unlock()
+			event = *next
 		}
+	}()
+}
+
+func handleFileEvent(event fsnotify.Event) {
+	//trees are updated first, so clients notified see the change
+	updateTrees(event.Name)
+	dropManifests(event.Name)
+	notifyFileEvent(event.Name)
+	if (event.Op & fsnotify.Write) == fsnotify.Write {
+		if _, ok := appCache.Get(event.Name); ok {
+			//cal hash and cache new file content if file was written
+			hashAndCacheFile(event.Name)
+		}
+	}
+
+	if (event.Op&fsnotify.Rename) == fsnotify.Rename || (event.Op&fsnotify.Remove) == fsnotify.Remove {
+		//delete file cache if it was renamed or removed
+		appCache.Delete(event.Name)
 	}
 }
 
-func readConfig() {
-	//read config
-	content, err := ioutil.ReadFile(filepath.Join(wd, "config.txt"))
+//cachedFile is a hashed file kept in appCache with its compressed forms,
+//the raw content is served from disk so it is not kept in memory
+type cachedFile struct {
+	path    string
+	hash    string
+	size    int64
+	modTime time.Time
+	head    []byte
+
+	mu      sync.Mutex
+	encoded map[string][]byte
+}
+
+//errFileChanged is returned when a cached file changed on disk since it was hashed
+var errFileChanged = errors.New("file changed since cached")
+
+//open opens the raw file, it fails if the file is not the one hashed
+func (cf *cachedFile) open() (*os.File, error) {
+	fr, err := os.Open(cf.path)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	fi, err := fr.Stat()
+	if err != nil {
+		fr.Close()
+		return nil, err
 	}
+	if fi.Size() != cf.size || !fi.ModTime().Equal(cf.modTime) {
+		fr.Close()
+		return nil, errFileChanged
+	}
+	return fr, nil
+}
 
-	err = json.Unmarshal(content, &config)
+//encode returns the content compressed with codec, codec must not be CodecNone
+func (cf *cachedFile) encode(codec string) ([]byte, error) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	if content, ok := cf.encoded[codec]; ok {
+		return content, nil
+	}
+	fr, err := cf.open()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	content, err := ioutil.ReadAll(fr)
+	fr.Close()
+	if err != nil {
+		return nil, err
+	}
+	if gsync.HashBytes(gsync.HashSHA256, content) != cf.hash {
+		return nil, errFileChanged
+	}
+	content, err = gsync.Compress(content, codec)
+	if err != nil {
+		return nil, err
 	}
+	cf.encoded[codec] = content
+	return content, nil
 }
 
 func hashAndCacheFile(fp string) error {
@@ -115,110 +305,264 @@ func hashAndCacheFile(fp string) error {
 	if err != nil {
 		return err
 	}
-	content, err := ioutil.ReadAll(fr)
+	defer fr.Close()
+	fi, err := fr.Stat()
 	if err != nil {
 		return err
 	}
-	fr.Close()
-	fileHash := fmt.Sprintf("%x", md5.Sum(content))
-	fileHashMapMu.Lock()
-	fileHashMap[fp] = fileHash
-	log.Printf("file %s hash:%s", fp, fileHash)
-	fileHashMapMu.Unlock()
-
-	var buf bytes.Buffer
-	gw := gzip.NewWriter(&buf)
-	_, gw.Name = filepath.Split(fp)
-	fi, err := os.Stat(fp)
-	if err != nil {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(fr, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 		return err
 	}
-	gw.ModTime = fi.ModTime()
-
-	_, err = io.Copy(gw, bytes.NewReader(content))
-	if err != nil {
+	head = head[:n]
+	h, _ := gsync.NewHash(gsync.HashSHA256)
+	h.Write(head)
+	if _, err = io.Copy(h, fr); err != nil {
 		return err
 	}
-	gw.Close()
+	fileHash := fmt.Sprintf("%x", h.Sum(nil))
+	log.Printf("file %s hash:%s", fp, fileHash)
 
-	content, _ = ioutil.ReadAll(&buf)
-	appCache.AddItem(fp, content, 24*time.Hour)
+	appCache.AddItem(fp, &cachedFile{
+		path:    fp,
+		hash:    fileHash,
+		size:    fi.Size(),
+		modTime: fi.ModTime(),
+		head:    head,
+		encoded: make(map[string][]byte),
+	}, 24*time.Hour)
 	return nil
 }
 
+//selectCodec picks the codec of a download from Accept-Encoding of the request
+func selectCodec(accept string) string {
+	codec := gsync.CodecNone
+	for _, e := range strings.Split(accept, ",") {
+		parts := strings.Split(e, ";")
+		if len(parts) > 1 && strings.TrimSpace(parts[1]) == "q=0" {
+			continue
+		}
+		switch strings.TrimSpace(parts[0]) {
+		case "zstd":
+			return gsync.CodecZstd
+		case "gzip":
+			codec = gsync.CodecGzip
+		}
+	}
+	return codec
+}
+
+//releaseDir returns the directory of release in appDir, the current release if release is empty
+func releaseDir(appDir string, release string) (string, string, error) {
+	if len(release) == 0 {
+		return gsync.CurrentRelease(appDir)
+	}
+	dir, err := gsync.ReleaseDir(appDir, release)
+	return release, dir, err
+}
+
+//authorize checks the bearer token of r against tokens of app
+func authorize(w http.ResponseWriter, r *http.Request, app *AppConfig) bool {
+	if len(app.Tokens) == 0 {
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		token := []byte(strings.TrimPrefix(auth, "Bearer "))
+		for _, t := range app.Tokens {
+			if subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+				return true
+			}
+		}
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(w, "unauthorized", 401)
+	return false
+}
+
 func createHttpRouter() http.Handler {
 	router := httprouter.New()
 
 	router.GET("/app/:app/*file", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		appName := p.ByName("app")
 		file := p.ByName("file")
-		app, ok := config.Apps[appName]
+		app, ok := getApp(appName)
 		if !ok {
 			http.Error(w, "file not found", 404)
 			return
 		}
+		if !authorize(w, r, app) {
+			return
+		}
 
-		fp := filepath.Clean(filepath.Join(app.AppDir, file))
-		content, ok := appCache.Get(fp)
+		_, dir, err := releaseDir(app.AppDir, r.URL.Query().Get("release"))
+		if err != nil {
+			http.Error(w, "release not found", 404)
+			return
+		}
+		//files out of the app dir, such as config and keys, are never served
+		fp, err := gsync.JoinDir(dir, file)
+		if err != nil {
+			http.Error(w, "file not found", 404)
+			return
+		}
+		v, ok := appCache.Get(fp)
 		if !ok {
 			err := hashAndCacheFile(fp)
 			if err != nil {
 				http.Error(w, "error cache file", 404)
 				return
 			}
-			if content, ok = appCache.Get(fp); !ok {
+			if v, ok = appCache.Get(fp); !ok {
 				http.Error(w, "not found", 404)
 				return
 			}
 		}
-		w.Header().Set("Content-Encoding", "gzip")
-		io.Copy(w, bytes.NewReader(content.([]byte)))
+		cf := v.(*cachedFile)
+		codec := selectCodec(r.Header.Get("Accept-Encoding"))
+		if gsync.Incompressible(fp, cf.head, app.NoCompress) {
+			//compressing gains nothing, so no compressed copy is cached either
+			codec = gsync.CodecNone
+		}
+		var content io.ReadSeeker
+		if codec == gsync.CodecNone {
+			fr, err := cf.open()
+			if err == nil {
+				defer fr.Close()
+				content = fr
+			}
+		} else {
+			encoded, err := cf.encode(codec)
+			if err == nil {
+				content = bytes.NewReader(encoded)
+			}
+		}
+		if content == nil {
+			//the file changed or is gone, it is hashed again on the next request
+			appCache.Delete(fp)
+			http.Error(w, "file changed", 503)
+			return
+		}
+		//ranges apply to the compressed content, so clients can resume downloads
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Vary", "Accept-Encoding")
+		if codec != gsync.CodecNone {
+			w.Header().Set("Content-Encoding", codec)
+		}
+		w.Header().Set("ETag", fmt.Sprintf("\"%s-%s\"", cf.hash, codec))
+		http.ServeContent(w, r, "", cf.modTime, content)
 	})
 
-	router.GET("/tmpfiles/:file", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	router.GET("/tmpfiles/:app/:file", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		appName := p.ByName("app")
 		file := p.ByName("file")
-		fr, err := os.Open(filepath.Join(config.CacheDir, file))
+		app, ok := getApp(appName)
+		if !ok {
+			http.Error(w, "file not found", 404)
+			return
+		}
+		if !authorize(w, r, app) {
+			return
+		}
+		//manifests, temp files and the dir itself are not patches
+		if strings.HasPrefix(file, ".") || strings.HasSuffix(file, ".json") {
+			http.Error(w, "file not found", 404)
+			return
+		}
+		fpath := filepath.Join(config.CacheDir, appName, file)
+		//only complete patches of the app are served
+		m, err := gsync.CheckPatch(fpath)
+		if err != nil || m.App != appName {
+			http.Error(w, "file not found", 404)
+			return
+		}
+		//the patch isn't evicted while it is streamed
+		release, ok := patchCache.Acquire(fpath)
+		if !ok {
+			http.Error(w, "file not found", 404)
+			return
+		}
+		defer release()
+		fr, err := os.Open(fpath)
 		if err != nil {
 			http.Error(w, "file not found", 404)
+			return
 		}
 		defer fr.Close()
-		io.Copy(w, fr)
+		fi, err := fr.Stat()
+		if err != nil {
+			http.Error(w, "file not found", 404)
+			return
+		}
+		//patches are named after the files they hold, the archive is tagged by its own hash
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("ETag", fmt.Sprintf("\"%s\"", m.Hash))
+		http.ServeContent(w, r, file, fi.ModTime(), fr)
 	})
 
 	router.POST("/hasupdate/:app", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		resp := &gsync.Response{}
-		app, ok := config.Apps[p.ByName("app")]
+		appName := p.ByName("app")
+		app, ok := getApp(appName)
 		if !ok {
 			content, _ := json.Marshal(resp)
-			fmt.Fprintf(w, string(content))
+			w.Write(content)
+			return
+		}
+		if !authorize(w, r, app) {
 			return
 		}
-		r.ParseForm()
 		req := &gsync.Request{}
-		err := json.Unmarshal([]byte(r.FormValue("req")), req)
+		if !readRequest(w, r, req) {
+			return
+		}
+		var dir string
+		var err error
+		resp.Release, dir, err = releaseDir(app.AppDir, req.Release)
 		if err != nil {
-			http.Error(w, "invalid request", 500)
+			http.Error(w, "release not found", 404)
+			return
+		}
+		if !gsync.SupportedHash(req.HashAlgo) {
+			http.Error(w, "unsupported hash algorithm", 400)
 			return
 		}
-		diff, err := gsync.CalcDiff(app.AppDir, req)
+		if !gsync.SupportedCodec(req.Codec) {
+			http.Error(w, "unsupported codec", 400)
+			return
+		}
+		resp.HashAlgo = gsync.HashName(req.HashAlgo)
+		resp.Modes = transferModes
+		tree, err := getTree(dir)
+		if err != nil {
+			http.Error(w, "scan app dir error", 500)
+			return
+		}
+		if len(req.RootHash) > 0 {
+			resp.RootHash = tree.RootHash(req.HashAlgo)
+			if resp.RootHash == req.RootHash || len(req.Hashes) == 0 {
+				//up to date, or the client sends its hashes next
+				content, _ := json.Marshal(resp)
+				w.Write(content)
+				return
+			}
+		}
+		diff, err := tree.CalcDiff(req)
 		if err != nil {
 			http.Error(w, "calc diff error", 500)
 			return
 		}
+		resp.Deleted = tree.CalcDeleted(req)
 		if len(diff) != 0 {
 			if req.ClientVersion == 0 {
-				resp.PatchFile, err = gsync.PrepareDiff(app.AppDir, config.CacheDir, diff)
+				var release func()
+				resp.PatchFile, resp.PatchSize, release, err = preparePatch(appName, app, dir, diff, req.Codec)
 				if err != nil {
 					http.Error(w, fmt.Sprintf("prepare diff error:%s", err), 500)
 					return
 				}
-				fi, err := os.Stat(resp.PatchFile)
-				if err != nil {
-					http.Error(w, "query patch size error", 500)
-					return
-				}
-				resp.PatchSize = fi.Size()
-				resp.PatchFile = strings.Replace(resp.PatchFile, config.CacheDir, "/tmpfiles", 1)
+				time.AfterFunc(patchPinPeriod, release)
 			}
 		}
 		resp.Diff = diff
@@ -227,12 +571,257 @@ func createHttpRouter() http.Handler {
 			http.Error(w, "marshal response error", 500)
 			return
 		}
-		fmt.Fprintf(w, string(content))
+		w.Write(content)
+	})
+
+	router.POST("/bundle/:app", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		appName := p.ByName("app")
+		app, ok := getApp(appName)
+		if !ok {
+			http.Error(w, "app not found", 404)
+			return
+		}
+		if !authorize(w, r, app) {
+			return
+		}
+		req := &gsync.Request{}
+		if !readRequest(w, r, req) {
+			return
+		}
+		if len(req.Scope) == 0 {
+			http.Error(w, "no files to bundle", 400)
+			return
+		}
+		if !gsync.SupportedHash(req.HashAlgo) {
+			http.Error(w, "unsupported hash algorithm", 400)
+			return
+		}
+		if !gsync.SupportedCodec(req.Codec) {
+			http.Error(w, "unsupported codec", 400)
+			return
+		}
+		resp := &gsync.Response{HashAlgo: gsync.HashName(req.HashAlgo)}
+		var dir string
+		var err error
+		resp.Release, dir, err = releaseDir(app.AppDir, req.Release)
+		if err != nil {
+			http.Error(w, "release not found", 404)
+			return
+		}
+		tree, err := getTree(dir)
+		if err != nil {
+			http.Error(w, "scan app dir error", 500)
+			return
+		}
+		//files of the scope differing from the hashes of the request
+		resp.Diff, err = tree.CalcDiff(req)
+		if err != nil {
+			http.Error(w, "calc diff error", 500)
+			return
+		}
+		if len(resp.Diff) > 0 {
+			var release func()
+			resp.PatchFile, resp.PatchSize, release, err = preparePatch(appName, app, dir, resp.Diff, req.Codec)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("prepare patch error:%s", err), 500)
+				return
+			}
+			//clients request the bundle again if it is gone
+			release()
+		}
+		content, err := json.Marshal(resp)
+		if err != nil {
+			http.Error(w, "marshal response error", 500)
+			return
+		}
+		w.Write(content)
+	})
+
+	router.POST("/tree/:app", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		app, ok := getApp(p.ByName("app"))
+		if !ok {
+			http.Error(w, "app not found", 404)
+			return
+		}
+		if !authorize(w, r, app) {
+			return
+		}
+		req := &gsync.TreeRequest{}
+		if !readRequest(w, r, req) {
+			return
+		}
+		if !gsync.SupportedHash(req.HashAlgo) {
+			http.Error(w, "unsupported hash algorithm", 400)
+			return
+		}
+		resp := &gsync.TreeResponse{}
+		var dir string
+		var err error
+		resp.Release, dir, err = releaseDir(app.AppDir, req.Release)
+		if err != nil {
+			http.Error(w, "release not found", 404)
+			return
+		}
+		tree, err := getTree(dir)
+		if err != nil {
+			http.Error(w, "scan app dir error", 500)
+			return
+		}
+		resp.Dirs = tree.MerkleChildren(req.HashAlgo, req.Dirs)
+		content, err := json.Marshal(resp)
+		if err != nil {
+			http.Error(w, "marshal response error", 500)
+			return
+		}
+		w.Write(content)
+	})
+
+	router.GET("/watch/:app", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		appName := p.ByName("app")
+		app, ok := getApp(appName)
+		if !ok {
+			http.Error(w, "app not found", 404)
+			return
+		}
+		if !authorize(w, r, app) {
+			return
+		}
+		since, _ := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+		timeout := defaultWatchTimeout
+		if t, err := strconv.Atoi(r.URL.Query().Get("timeout")); err == nil && t > 0 && time.Duration(t)*time.Second < timeout {
+			timeout = time.Duration(t) * time.Second
+		}
+		resp := &gsync.WatchResponse{}
+		if since == 0 {
+			//first call just gets the current version
+			resp.Version = getNotifier(appName).current()
+		} else {
+			resp.Version = getNotifier(appName).wait(since, timeout)
+			resp.Changed = resp.Version != since
+			//the app may be removed while waiting
+			if _, ok := getApp(appName); !ok {
+				http.Error(w, "app not found", 404)
+				return
+			}
+		}
+		content, err := json.Marshal(resp)
+		if err != nil {
+			http.Error(w, "marshal response error", 500)
+			return
+		}
+		w.Write(content)
+	})
+
+	router.GET("/manifest/:app", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		appName := p.ByName("app")
+		app, ok := getApp(appName)
+		if !ok {
+			http.Error(w, "app not found", 404)
+			return
+		}
+		if !authorize(w, r, app) {
+			return
+		}
+		if app.signingKey == nil {
+			http.Error(w, "manifest not signed", 404)
+			return
+		}
+		release, dir, err := releaseDir(app.AppDir, r.URL.Query().Get("release"))
+		if err != nil {
+			http.Error(w, "release not found", 404)
+			return
+		}
+		sm, err := signedManifest(appName, release, dir, app.signingKey)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("make manifest error:%s", err), 500)
+			return
+		}
+		content, err := json.Marshal(sm)
+		if err != nil {
+			http.Error(w, "marshal response error", 500)
+			return
+		}
+		w.Write(content)
+	})
+
+	router.POST("/delta/:app", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		app, ok := getApp(p.ByName("app"))
+		if !ok {
+			http.Error(w, "app not found", 404)
+			return
+		}
+		if !authorize(w, r, app) {
+			return
+		}
+		req := &gsync.Request{}
+		if !readRequest(w, r, req) {
+			return
+		}
+		resp := &gsync.Response{}
+		var dir string
+		var err error
+		resp.Release, dir, err = releaseDir(app.AppDir, req.Release)
+		if err != nil {
+			http.Error(w, "release not found", 404)
+			return
+		}
+		resp.Deltas, err = gsync.CalcDeltas(dir, req)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("calc delta error:%s", err), 500)
+			return
+		}
+		content, err := json.Marshal(resp)
+		if err != nil {
+			http.Error(w, "marshal response error", 500)
+			return
+		}
+		w.Write(content)
 	})
 	return router
 }
 
+//publish copies srcdir into a new release of app
+func publish(appName string, srcdir string) {
+	app, ok := getApp(appName)
+	if !ok {
+		log.Fatalf("app %s was not configed", appName)
+	}
+	if !filepath.IsAbs(app.AppDir) {
+		app.AppDir = filepath.Join(wd, app.AppDir)
+	}
+	release, err := gsync.PublishRelease(app.AppDir, srcdir)
+	if err != nil {
+		log.Fatalf("publish %s error:%v", appName, err)
+	}
+	log.Printf("published %s release %s", appName, release)
+	if err = gsync.PruneReleases(app.AppDir, app.KeepReleases); err != nil {
+		log.Printf("prune releases error:%v", err)
+	}
+}
+
 func main() {
+	var publishDir, publishApp string
+	var genkey bool
+	flag.StringVar(&publishDir, "publish", "", "publish dir as a new release of app")
+	flag.StringVar(&publishApp, "app", "", "app to publish")
+	flag.BoolVar(&genkey, "genkey", false, "generate a key pair to sign manifests")
+	flag.Parse()
+	if genkey {
+		pub, key, err := gsync.GenerateKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("public key:  %s\nsigning key: %s\n", pub, key)
+		return
+	}
+	if len(publishDir) > 0 {
+		//resolve publish dir before changing working dir
+		var err error
+		if publishDir, err = filepath.Abs(publishDir); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
 	os.Chdir(dir)
 	if err != nil {
@@ -242,33 +831,63 @@ func main() {
 
 	//read config
 	readConfig()
+	if len(publishDir) > 0 {
+		publish(publishApp, publishDir)
+		return
+	}
 	if len(config.Apps) == 0 {
 		log.Printf("none apps were configed\n")
 		return
 	}
 
 	appCache = gsync.CreateCache(100)
-	fileHashMap = make(map[string]string)
+	if err := startPatchCache(); err != nil {
+		log.Fatalf("load patch cache error:%v", err)
+	}
+	notifiers = make(map[string]*appNotifier)
 
 	//watch file modify events
 	in, out := NotifyPipeChan(500 * time.Millisecond)
-	stopc := make(chan struct{})
-	var apps []string
+	if err := startWatcher(in); err != nil {
+		log.Fatal(err)
+	}
 	for _, app := range config.Apps {
-		if !filepath.IsAbs(app.AppDir) {
-			app.AppDir = filepath.Join(wd, app.AppDir)
-		}
-		if _, err := os.Stat(app.AppDir); err != nil && !os.IsExist(err) {
-			continue
+		if err := watchApp(app.AppDir); err != nil {
+			log.Fatal(err)
 		}
-
-		log.Printf("watch dir:%s", app.AppDir)
-		apps = append(apps, app.AppDir)
 	}
-	go watchApps(apps, stopc, in)
 	go watchFileEvents(out)
+	go watchConfig()
 
 	router := createHttpRouter()
 	log.Printf("listen on %s", config.Listen)
-	log.Fatal(http.ListenAndServe(config.Listen, router))
+	if len(config.TLSCert) == 0 {
+		log.Fatal(http.ListenAndServe(config.Listen, router))
+	}
+	server, err := createTLSServer(router)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Fatal(server.ListenAndServeTLS(config.TLSCert, config.TLSKey))
+}
+
+//createTLSServer creates an https server, which verifies client certificates if ClientCA is configed
+func createTLSServer(handler http.Handler) (*http.Server, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(config.ClientCA) > 0 {
+		pem, err := ioutil.ReadFile(config.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", config.ClientCA)
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &http.Server{
+		Addr:      config.Listen,
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+	}, nil
 }
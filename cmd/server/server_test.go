@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"gsync"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_AppFileOutOfDir(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "gsync.")
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "publish/pub"), 0777)
+	os.MkdirAll(filepath.Join(dir, "keys"), 0777)
+	ioutil.WriteFile(filepath.Join(dir, "publish/pub/a.txt"), []byte("public"), 0666)
+	ioutil.WriteFile(filepath.Join(dir, "config.txt"), []byte(`{"apps":{}}`), 0666)
+	ioutil.WriteFile(filepath.Join(dir, "keys/priv.key"), []byte("secret"), 0666)
+
+	oldConfig, oldCache := config, appCache
+	defer func() { config, appCache = oldConfig, oldCache }()
+	config.Apps = map[string]*AppConfig{
+		"pub":  {AppDir: filepath.Join(dir, "publish/pub")},
+		"priv": {AppDir: filepath.Join(dir, "keys"), Tokens: []string{"t"}},
+	}
+	appCache = gsync.CreateCache(10)
+	router := createHttpRouter()
+
+	get := func(url string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		return w.Code
+	}
+	if code := get("/app/pub/a.txt"); code != 200 {
+		t.Fatalf("expect file of app served, got %d", code)
+	}
+	for _, url := range []string{
+		"/app/pub/../../config.txt",
+		"/app/pub/%2e%2e/%2e%2e/config.txt",
+		"/app/pub/../../keys/priv.key",
+		"/app/pub/..",
+		"/app/pub/a.txt?release=../../..",
+	} {
+		if code := get(url); code != 404 {
+			t.Errorf("expect %s not found, got %d", url, code)
+		}
+	}
+}
+
+func Test_ResyncApps(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "gsync.")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0666)
+
+	oldConfig, oldCache, oldNotifiers := config, appCache, notifiers
+	defer func() { config, appCache, notifiers = oldConfig, oldCache, oldNotifiers }()
+	config.Apps = map[string]*AppConfig{"app": {AppDir: dir}}
+	appCache = gsync.CreateCache(10)
+	notifiers = make(map[string]*appNotifier)
+
+	tree, err := getTree(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := getNotifier("app").current()
+	//a file changed while events were lost
+	ioutil.WriteFile(filepath.Join(dir, "b.txt"), []byte("b"), 0666)
+	resyncApps()
+	if getNotifier("app").current() == version {
+		t.Fatal("expect watchers notified")
+	}
+	rescanned, err := getTree(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rescanned == tree || rescanned.RootHash(gsync.HashSHA256) == tree.RootHash(gsync.HashSHA256) {
+		t.Fatal("expect tree scanned again")
+	}
+}
+
+func Test_NotifyNestedApps(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "gsync.")
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "outer/inner"), 0777)
+
+	oldConfig, oldNotifiers := config, notifiers
+	defer func() { config, notifiers = oldConfig, oldNotifiers }()
+	config.Apps = map[string]*AppConfig{
+		"outer": {AppDir: filepath.Join(dir, "outer")},
+		"inner": {AppDir: filepath.Join(dir, "outer/inner")},
+		"other": {AppDir: filepath.Join(dir, "other")},
+		//a release app containing the others
+		"root": {AppDir: dir},
+	}
+	notifiers = make(map[string]*appNotifier)
+	versions := func() map[string]int64 {
+		v := make(map[string]int64)
+		for appName := range config.Apps {
+			v[appName] = getNotifier(appName).current()
+		}
+		return v
+	}
+	ioutil.WriteFile(filepath.Join(dir, "current"), []byte("1"), 0666)
+
+	for i := 0; i < 10; i++ {
+		before := versions()
+		notifyFileEvent(filepath.Join(dir, "outer/inner/a.txt"))
+		after := versions()
+		for appName, notified := range map[string]bool{"outer": true, "inner": true, "other": false, "root": false} {
+			if (after[appName] != before[appName]) != notified {
+				t.Fatalf("expect app %s notified %v", appName, notified)
+			}
+		}
+	}
+	before := versions()
+	notifyFileEvent(filepath.Join(dir, "current"))
+	if after := versions(); after["root"] == before["root"] || after["outer"] != before["outer"] {
+		t.Fatal("expect only release app notified on switching current")
+	}
+}
+
+func Test_AppFileFromDisk(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "gsync.")
+	defer os.RemoveAll(dir)
+	fp := filepath.Join(dir, "a.txt")
+	ioutil.WriteFile(fp, bytes.Repeat([]byte("text "), 1000), 0666)
+
+	oldConfig, oldCache := config, appCache
+	defer func() { config, appCache = oldConfig, oldCache }()
+	config.Apps = map[string]*AppConfig{"app": {AppDir: dir}}
+	appCache = gsync.CreateCache(10)
+	router := createHttpRouter()
+
+	get := func(codec string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/app/app/a.txt", nil)
+		r.Header.Set("Accept-Encoding", codec)
+		router.ServeHTTP(w, r)
+		return w
+	}
+	if w := get(gsync.CodecNone); w.Code != 200 || w.Body.String() != strings.Repeat("text ", 1000) {
+		t.Fatalf("expect raw file served, got %d", w.Code)
+	}
+	w := get(gsync.CodecGzip)
+	if w.Code != 200 || w.Header().Get("Content-Encoding") != gsync.CodecGzip {
+		t.Fatalf("expect gzip file served, got %d", w.Code)
+	}
+	v, _ := appCache.Get(fp)
+	if cf := v.(*cachedFile); len(cf.encoded) != 1 || cf.encoded[gsync.CodecGzip] == nil {
+		t.Fatal("expect only the compressed content cached")
+	}
+
+	//a change not hashed yet is never served under the old hash
+	ioutil.WriteFile(fp, []byte("changed"), 0666)
+	if w := get(gsync.CodecNone); w.Code != 503 {
+		t.Fatalf("expect changed file unavailable, got %d", w.Code)
+	}
+	if w := get(gsync.CodecNone); w.Code != 200 || w.Body.String() != "changed" {
+		t.Fatalf("expect changed file hashed again, got %d %s", w.Code, w.Body.String())
+	}
+}
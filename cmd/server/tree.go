@@ -0,0 +1,78 @@
+package main
+
+import (
+	"gsync"
+	"log"
+	"sync"
+)
+
+//treeEntry is a tree which can be used after ready is closed
+type treeEntry struct {
+	tree  *gsync.Tree
+	ready chan struct{}
+	err   error
+}
+
+var (
+	//file trees by dir, scanned on first use and then updated by file events
+	trees   = make(map[string]*treeEntry)
+	treesMu sync.Mutex
+)
+
+//getTree returns the tree of dir, scanning it if it is new
+func getTree(dir string) (*gsync.Tree, error) {
+	treesMu.Lock()
+	e, ok := trees[dir]
+	if ok {
+		treesMu.Unlock()
+		<-e.ready
+		return e.tree, e.err
+	}
+	//registered before scanning, so events during the scan are applied after it
+	e = &treeEntry{tree: gsync.NewTree(dir), ready: make(chan struct{})}
+	trees[dir] = e
+	treesMu.Unlock()
+
+	if e.err = e.tree.Scan(); e.err != nil {
+		treesMu.Lock()
+		delete(trees, dir)
+		treesMu.Unlock()
+	} else {
+		log.Printf("scanned tree of %s", dir)
+	}
+	close(e.ready)
+	return e.tree, e.err
+}
+
+//updateTrees applies a change of fp to trees containing it
+func updateTrees(fp string) {
+	treesMu.Lock()
+	all := make([]*gsync.Tree, 0, len(trees))
+	for _, e := range trees {
+		all = append(all, e.tree)
+	}
+	treesMu.Unlock()
+	for _, tree := range all {
+		if err := tree.Update(fp); err != nil {
+			log.Printf("update tree of %s error:%v", tree.Dir(), err)
+		}
+	}
+}
+
+//dropTrees drops trees of dir and its sub dirs, except the ones in or under keep, which are still watched
+func dropTrees(dir string, keep []string) {
+	treesMu.Lock()
+	defer treesMu.Unlock()
+	for k := range trees {
+		if gsync.InDirs(k, []string{dir}) && !gsync.InDirs(k, keep) {
+			delete(trees, k)
+		}
+	}
+}
+
+//dropAllTrees drops all trees, they are scanned again on next use
+func dropAllTrees() {
+	treesMu.Lock()
+	defer treesMu.Unlock()
+	trees = make(map[string]*treeEntry)
+}
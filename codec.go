@@ -0,0 +1,127 @@
+package gsync
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+//compression codecs of patches and downloads
+const (
+	CodecGzip = "gzip"
+	CodecZstd = "zstd"
+	CodecNone = "none"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+//CodecName returns the name of codec, gzip if codec is empty as sent by old clients
+func CodecName(codec string) string {
+	if len(codec) == 0 {
+		return CodecGzip
+	}
+	return codec
+}
+
+//SupportedCodec reports whether codec can be used
+func SupportedCodec(codec string) bool {
+	switch CodecName(codec) {
+	case CodecGzip, CodecZstd, CodecNone:
+		return true
+	}
+	return false
+}
+
+//CodecExt returns the extension of a tar compressed with codec
+func CodecExt(codec string) string {
+	switch CodecName(codec) {
+	case CodecZstd:
+		return ".tar.zst"
+	case CodecNone:
+		return ".tar"
+	}
+	return ".tar.gz"
+}
+
+//CodecEncoding returns the http content coding of codec
+func CodecEncoding(codec string) string {
+	if CodecName(codec) == CodecNone {
+		return "identity"
+	}
+	return CodecName(codec)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+//NewCodecWriter compresses writes to w with codec. Close flushes but doesn't close w
+func NewCodecWriter(w io.Writer, codec string) (io.WriteCloser, error) {
+	switch CodecName(codec) {
+	case CodecGzip:
+		return gzip.NewWriter(w), nil
+	case CodecZstd:
+		return zstd.NewWriter(w)
+	case CodecNone:
+		return nopWriteCloser{w}, nil
+	}
+	return nil, fmt.Errorf("unsupported codec %s", codec)
+}
+
+//NewCodecReader decompresses r with codec
+func NewCodecReader(r io.Reader, codec string) (io.ReadCloser, error) {
+	switch CodecName(codec) {
+	case CodecGzip:
+		return gzip.NewReader(r)
+	case CodecZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case CodecNone:
+		return ioutil.NopCloser(r), nil
+	}
+	return nil, fmt.Errorf("unsupported codec %s", codec)
+}
+
+//DetectCodec decompresses r with the codec detected from its magic bytes
+func DetectCodec(r io.Reader) (io.ReadCloser, string, error) {
+	br := bufio.NewReader(r)
+	codec := CodecNone
+	if magic, _ := br.Peek(len(zstdMagic)); bytes.HasPrefix(magic, zstdMagic) {
+		codec = CodecZstd
+	} else if bytes.HasPrefix(magic, gzipMagic) {
+		codec = CodecGzip
+	}
+	cr, err := NewCodecReader(br, codec)
+	return cr, codec, err
+}
+
+//Compress compresses content with codec
+func Compress(content []byte, codec string) ([]byte, error) {
+	var buf bytes.Buffer
+	cw, err := NewCodecWriter(&buf, codec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = cw.Write(content); err != nil {
+		return nil, err
+	}
+	if err = cw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
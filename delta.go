@@ -0,0 +1,249 @@
+package gsync
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+//DefaultBlockSize is the block size used for file signatures
+const DefaultBlockSize = 8 * 1024
+
+//BlockSig holds the checksums of one block of a file
+type BlockSig struct {
+	Weak   uint32
+	Strong string
+}
+
+//Signature describes a file as a list of block checksums
+type Signature struct {
+	BlockSize int
+	Size      int64
+	Blocks    []BlockSig
+}
+
+//DeltaOp is a delta instruction. if Data is empty, Count blocks starting from
+//Block are copied from the old file, otherwise Data is written as is.
+type DeltaOp struct {
+	Block int    `json:",omitempty"`
+	Count int    `json:",omitempty"`
+	Data  []byte `json:",omitempty"`
+}
+
+//Delta describes how to rebuild a new file from an old one
+type Delta struct {
+	BlockSize int
+	Ops       []DeltaOp
+}
+
+//LiteralSize returns the number of bytes the delta carries as is
+func (d *Delta) LiteralSize() int64 {
+	var n int64
+	for _, op := range d.Ops {
+		n += int64(len(op.Data))
+	}
+	return n
+}
+
+//rollingSum is the rsync weak checksum
+type rollingSum struct {
+	a, b uint32
+	n    uint32
+}
+
+func (r *rollingSum) init(p []byte) {
+	r.a, r.b = 0, 0
+	r.n = uint32(len(p))
+	for i, c := range p {
+		r.a += uint32(c)
+		r.b += uint32(len(p)-i) * uint32(c)
+	}
+}
+
+func (r *rollingSum) roll(out, in byte) {
+	r.a = r.a - uint32(out) + uint32(in)
+	r.b = r.b - r.n*uint32(out) + r.a
+}
+
+func (r *rollingSum) sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+func weakSum(p []byte) uint32 {
+	var r rollingSum
+	r.init(p)
+	return r.sum()
+}
+
+func strongSum(p []byte) string {
+	return fmt.Sprintf("%x", md5.Sum(p))
+}
+
+//MakeSignature calcs block checksums of r
+func MakeSignature(r io.Reader, blockSize int) (*Signature, error) {
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	sig := &Signature{BlockSize: blockSize}
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sig.Size += int64(n)
+			sig.Blocks = append(sig.Blocks, BlockSig{
+				Weak:   weakSum(buf[:n]),
+				Strong: strongSum(buf[:n]),
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sig, nil
+}
+
+//MakeFileSignature calcs block checksums of file fpath
+func MakeFileSignature(fpath string, blockSize int) (*Signature, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return MakeSignature(bufio.NewReader(f), blockSize)
+}
+
+type deltaWriter struct {
+	delta   *Delta
+	literal []byte
+}
+
+func (w *deltaWriter) addLiteral(c byte) {
+	w.literal = append(w.literal, c)
+	if len(w.literal) >= w.delta.BlockSize {
+		w.flush()
+	}
+}
+
+func (w *deltaWriter) addBlock(block int) {
+	w.flush()
+	if n := len(w.delta.Ops); n > 0 {
+		last := &w.delta.Ops[n-1]
+		if len(last.Data) == 0 && last.Block+last.Count == block {
+			last.Count++
+			return
+		}
+	}
+	w.delta.Ops = append(w.delta.Ops, DeltaOp{Block: block, Count: 1})
+}
+
+func (w *deltaWriter) flush() {
+	if len(w.literal) == 0 {
+		return
+	}
+	w.delta.Ops = append(w.delta.Ops, DeltaOp{Data: w.literal})
+	w.literal = nil
+}
+
+//MakeDelta calcs instructions to rebuild the content of r from a file described by sig
+func MakeDelta(sig *Signature, r io.Reader) (*Delta, error) {
+	blockSize := sig.BlockSize
+	if blockSize <= 0 {
+		return nil, fmt.Errorf("invalid block size %d", blockSize)
+	}
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	weaks := make(map[uint32][]int)
+	for i, b := range sig.Blocks {
+		weaks[b.Weak] = append(weaks[b.Weak], i)
+	}
+	//the last block may be shorter than blockSize
+	var tail []int
+	if n := len(sig.Blocks); n > 0 && sig.Size%int64(blockSize) != 0 {
+		tail = []int{n - 1}
+	}
+
+	w := &deltaWriter{delta: &Delta{BlockSize: blockSize}}
+	var rs rollingSum
+	pos := 0
+	rolling := false
+	for pos < len(content) {
+		end := pos + blockSize
+		if end > len(content) {
+			break
+		}
+		if !rolling {
+			rs.init(content[pos:end])
+			rolling = true
+		}
+		if block, ok := matchBlock(sig, weaks[rs.sum()], content[pos:end]); ok {
+			w.addBlock(block)
+			pos = end
+			rolling = false
+			continue
+		}
+		w.addLiteral(content[pos])
+		if end < len(content) {
+			rs.roll(content[pos], content[end])
+		}
+		pos++
+	}
+	//remaining bytes are shorter than a block, try the short last block
+	if pos < len(content) {
+		rest := content[pos:]
+		if block, ok := matchBlock(sig, tail, rest); ok && weakSum(rest) == sig.Blocks[block].Weak {
+			w.addBlock(block)
+		} else {
+			for _, c := range rest {
+				w.addLiteral(c)
+			}
+		}
+	}
+	w.flush()
+	return w.delta, nil
+}
+
+func matchBlock(sig *Signature, candidates []int, p []byte) (int, bool) {
+	if len(candidates) == 0 {
+		return 0, false
+	}
+	strong := strongSum(p)
+	for _, i := range candidates {
+		if sig.Blocks[i].Strong == strong {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+//ApplyDelta rebuilds new content from base according to delta
+func ApplyDelta(base io.ReaderAt, delta *Delta) ([]byte, error) {
+	var buf bytes.Buffer
+	block := make([]byte, delta.BlockSize)
+	for _, op := range delta.Ops {
+		if len(op.Data) > 0 {
+			buf.Write(op.Data)
+			continue
+		}
+		for i := op.Block; i < op.Block+op.Count; i++ {
+			n, err := base.ReadAt(block, int64(i)*int64(delta.BlockSize))
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			if n == 0 {
+				return nil, fmt.Errorf("block %d out of range", i)
+			}
+			buf.Write(block[:n])
+		}
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,55 @@
+package gsync
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//DiffDirs compares dirs with the old ones, it returns sorted dirs added and removed
+func DiffDirs(old []string, dirs []string) (added []string, removed []string) {
+	oldSet := make(map[string]bool)
+	for _, dir := range old {
+		oldSet[filepath.Clean(dir)] = true
+	}
+	newSet := make(map[string]bool)
+	for _, dir := range dirs {
+		newSet[filepath.Clean(dir)] = true
+	}
+	for dir := range newSet {
+		if !oldSet[dir] {
+			added = append(added, dir)
+		}
+	}
+	for dir := range oldSet {
+		if !newSet[dir] {
+			removed = append(removed, dir)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+//InDirs reports whether path p is any of dirs or under it
+func InDirs(p string, dirs []string) bool {
+	p = filepath.Clean(p)
+	for _, dir := range dirs {
+		dir = filepath.Clean(dir)
+		if p == dir || strings.HasPrefix(p, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+//JoinDir joins slash separated name to dir, names out of dir are rejected
+func JoinDir(dir string, name string) (string, error) {
+	fp := filepath.Join(dir, filepath.FromSlash(name))
+	rel, err := filepath.Rel(dir, fp)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %s is out of %s", name, dir)
+	}
+	return fp, nil
+}
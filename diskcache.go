@@ -0,0 +1,197 @@
+package gsync
+
+import (
+	"container/list"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type diskCacheFile struct {
+	path     string
+	size     int64
+	accessAt time.Time
+	//readers streaming the file, it is not removed while any
+	readers int
+	elem    *list.Element
+}
+
+//DiskCache limits the total size and the age of files in a cache dir.
+//least recently accessed files are removed first, files being read are never removed
+type DiskCache struct {
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+	//Companion returns the path of a file belonging to fpath, such as its manifest.
+	//companions are not cached on their own but removed along with their files
+	Companion func(fpath string) string
+
+	mu    sync.Mutex
+	size  int64
+	files map[string]*diskCacheFile
+	//lru holds files by access time, the least recently accessed first
+	lru *list.List
+}
+
+//NewDiskCache creates a cache of dir. maxSize and maxAge are not limited if 0, call Load to add existing files
+func NewDiskCache(dir string, maxSize int64, maxAge time.Duration) *DiskCache {
+	return &DiskCache{
+		dir:     filepath.Clean(dir),
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		files:   make(map[string]*diskCacheFile),
+		lru:     list.New(),
+	}
+}
+
+//Load adds files already in the cache dir, taking their modify time as access time
+func (c *DiskCache) Load() error {
+	var files []*diskCacheFile
+	err := filepath.Walk(c.dir, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, &diskCacheFile{path: fpath, size: info.Size(), accessAt: info.ModTime()})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	companions := make(map[string]bool)
+	if c.Companion != nil {
+		for _, f := range files {
+			companions[c.Companion(f.path)] = true
+		}
+	}
+	c.mu.Lock()
+	for _, f := range files {
+		if !companions[f.path] {
+			c.add(f)
+		}
+	}
+	c.mu.Unlock()
+	c.Evict()
+	return nil
+}
+
+//add inserts f by its access time, or updates the file of the same path in place,
+//so releases of its readers count on it. it returns the file in the cache, c.mu must be locked
+func (c *DiskCache) add(f *diskCacheFile) *diskCacheFile {
+	if old, ok := c.files[f.path]; ok {
+		c.size -= old.size
+		c.lru.Remove(old.elem)
+		old.size, old.accessAt = f.size, f.accessAt
+		f = old
+	}
+	c.files[f.path] = f
+	c.size += f.size
+	e := c.lru.Back()
+	for e != nil && e.Value.(*diskCacheFile).accessAt.After(f.accessAt) {
+		e = e.Prev()
+	}
+	if e == nil {
+		f.elem = c.lru.PushFront(f)
+	} else {
+		f.elem = c.lru.InsertAfter(f, e)
+	}
+	return f
+}
+
+//Add adds or refreshes file fpath as just accessed, then evicts files over the limits
+func (c *DiskCache) Add(fpath string) error {
+	_, release, err := c.AddAndAcquire(fpath)
+	if err != nil {
+		return err
+	}
+	release()
+	return nil
+}
+
+//AddAndAcquire adds or refreshes file fpath as just accessed and marks it being read,
+//so it isn't removed until release is called. it returns the size of the file
+func (c *DiskCache) AddAndAcquire(fpath string) (size int64, release func(), err error) {
+	fpath = filepath.Clean(fpath)
+	c.mu.Lock()
+	//stated under the lock, so the file isn't removed before it is pinned
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		c.mu.Unlock()
+		return 0, nil, err
+	}
+	f := c.add(&diskCacheFile{path: fpath, size: fi.Size(), accessAt: time.Now()})
+	f.readers++
+	c.mu.Unlock()
+	return f.size, c.releaser(f), nil
+}
+
+//Acquire marks file fpath accessed and being read, so it isn't removed until release is called.
+//ok is false if fpath is not in the cache
+func (c *DiskCache) Acquire(fpath string) (release func(), ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, ok := c.files[filepath.Clean(fpath)]
+	if !ok {
+		return nil, false
+	}
+	f.accessAt = time.Now()
+	c.add(f)
+	f.readers++
+	return c.releaser(f), true
+}
+
+//releaser returns the func to call when f is not read any more
+func (c *DiskCache) releaser(f *diskCacheFile) func() {
+	return func() {
+		c.mu.Lock()
+		f.readers--
+		c.mu.Unlock()
+		//the file may be over the limits now
+		c.Evict()
+	}
+}
+
+//Size returns the total size of files in the cache
+func (c *DiskCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+//Evict removes files older than the max age, then least recently accessed files
+//until the total size is within the max size. it returns paths of removed files
+func (c *DiskCache) Evict() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var removed []string
+	now := time.Now()
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		f := e.Value.(*diskCacheFile)
+		expired := c.maxAge > 0 && now.Sub(f.accessAt) > c.maxAge
+		//the latest file is kept even if it is larger than the max size alone
+		oversize := c.maxSize > 0 && c.size > c.maxSize && e != c.lru.Back()
+		if !expired && !oversize {
+			break
+		}
+		//removed while holding the lock, so a file added again meanwhile isn't removed
+		if f.readers == 0 {
+			if err := os.Remove(f.path); err == nil || os.IsNotExist(err) {
+				if c.Companion != nil {
+					os.Remove(c.Companion(f.path))
+				}
+				c.lru.Remove(e)
+				delete(c.files, f.path)
+				c.size -= f.size
+				removed = append(removed, f.path)
+			}
+		}
+		e = next
+	}
+	return removed
+}
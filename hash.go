@@ -0,0 +1,79 @@
+package gsync
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+//hash algorithms of file hashes in Request and Diff
+const (
+	HashMD5     = "md5"
+	HashSHA256  = "sha256"
+	HashBLAKE2b = "blake2b"
+)
+
+var hashFuncs = map[string]func() hash.Hash{
+	HashMD5:    md5.New,
+	HashSHA256: sha256.New,
+	HashBLAKE2b: func() hash.Hash {
+		h, _ := blake2b.New256(nil)
+		return h
+	},
+}
+
+//HashName returns the name of algo, md5 if algo is empty as sent by old clients
+func HashName(algo string) string {
+	if len(algo) == 0 {
+		return HashMD5
+	}
+	return algo
+}
+
+//SupportedHash reports whether algo can be used
+func SupportedHash(algo string) bool {
+	_, ok := hashFuncs[HashName(algo)]
+	return ok
+}
+
+//NewHash creates a hash of algo
+func NewHash(algo string) (hash.Hash, error) {
+	f, ok := hashFuncs[HashName(algo)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash algorithm %s", algo)
+	}
+	return f(), nil
+}
+
+//HashBytes returns hash of content in hex, empty if algo is not supported
+func HashBytes(algo string, content []byte) string {
+	h, err := NewHash(algo)
+	if err != nil {
+		return ""
+	}
+	h.Write(content)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+//hashAll hashes r with all supported algorithms in one pass
+func hashAll(r io.Reader) (map[string]string, error) {
+	hashes := make(map[string]hash.Hash)
+	writers := make([]io.Writer, 0, len(hashFuncs))
+	for algo, f := range hashFuncs {
+		h := f()
+		hashes[algo] = h
+		writers = append(writers, h)
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), r); err != nil {
+		return nil, err
+	}
+	sums := make(map[string]string)
+	for algo, h := range hashes {
+		sums[algo] = fmt.Sprintf("%x", h.Sum(nil))
+	}
+	return sums, nil
+}
@@ -0,0 +1,82 @@
+package gsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//files modified this close to hashing may change again within mtime resolution,
+//so their hashes are not cached
+const racyModTime = 2 * time.Second
+
+//IndexEntry holds hashes of a file, valid while its stat data is unchanged
+type IndexEntry struct {
+	Size    int64
+	ModTime time.Time
+	Inode   uint64 `json:",omitempty"`
+	//Hashes by hash algorithm
+	Hashes map[string]string
+}
+
+//HashIndex caches file hashes of a dir, so unchanged files are not read again
+type HashIndex struct {
+	Files map[string]*IndexEntry
+
+	path string
+}
+
+//LoadHashIndex reads the index kept in fpath. a missing or broken index is empty
+func LoadHashIndex(fpath string) *HashIndex {
+	idx := &HashIndex{path: fpath}
+	if content, err := ioutil.ReadFile(fpath); err == nil {
+		json.Unmarshal(content, idx)
+	}
+	if idx.Files == nil {
+		idx.Files = make(map[string]*IndexEntry)
+	}
+	return idx
+}
+
+//Save writes the index back to its file
+func (idx *HashIndex) Save() error {
+	content, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	tmpfile := idx.path + ".tmp"
+	if err = ioutil.WriteFile(tmpfile, content, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmpfile, idx.path)
+}
+
+//hashFile returns hash of file name in dir, from the index if its stat data is unchanged
+func (idx *HashIndex) hashFile(dir string, name string, algo string, files map[string]*IndexEntry) (string, error) {
+	fpath := filepath.Join(dir, name)
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		return "", fmt.Errorf("stat file %s err:%v", fpath, err)
+	}
+	inode := fileInode(fi)
+	e, ok := idx.Files[name]
+	if !ok || e.Size != fi.Size() || !e.ModTime.Equal(fi.ModTime()) || e.Inode != inode {
+		e = &IndexEntry{Size: fi.Size(), ModTime: fi.ModTime(), Inode: inode, Hashes: make(map[string]string)}
+	}
+	hash, ok := e.Hashes[algo]
+	if !ok {
+		content, err := ioutil.ReadFile(fpath)
+		if err != nil {
+			return "", fmt.Errorf("read file %s err:%v", fpath, err)
+		}
+		hash = HashBytes(algo, content)
+		e.Hashes[algo] = hash
+	}
+	if time.Since(fi.ModTime()) > racyModTime {
+		files[name] = e
+	}
+	return hash, nil
+}
@@ -0,0 +1,10 @@
+// +build windows
+
+package gsync
+
+import "os"
+
+//file index of windows needs an open handle, files are checked by size and mtime only
+func fileInode(fi os.FileInfo) uint64 {
+	return 0
+}
@@ -2,16 +2,18 @@ package gsync
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
-	"compress/gzip"
-	"crypto/md5"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -23,15 +25,54 @@ type Diff struct {
 	NewSize int64
 	Mode    os.FileMode
 	ModTime time.Time
+	//CopyFrom is a client file having the same content as the new file
+	CopyFrom string `json:",omitempty"`
 }
 
 //DiffMap Holds differences
 type DiffMap map[string]Diff
 
 type Response struct {
+	//Release is the release id the diff was calculated on
+	Release string `json:",omitempty"`
+	//HashAlgo is the algorithm of hashes in Diff, echoed from the request
+	HashAlgo  string `json:",omitempty"`
 	PatchFile string
 	PatchSize int64
 	Diff      DiffMap
+	//Deleted holds files the client has but the server doesn't
+	Deleted []string          `json:",omitempty"`
+	Deltas  map[string]*Delta `json:",omitempty"`
+	//RootHash is the merkle root of the server files, set if the request has one
+	RootHash string `json:",omitempty"`
+	//Modes lists transfer modes the server supports, old servers send none
+	Modes []string `json:",omitempty"`
+}
+
+//transfer modes of changed files
+const (
+	//TransferFile downloads files one by one from /app
+	TransferFile = "file"
+	//TransferBundle downloads many files in one patch from /bundle
+	TransferBundle = "bundle"
+	//TransferDelta patches big files with block deltas from /delta
+	TransferDelta = "delta"
+)
+
+//HasMode reports whether the server supports transfer mode
+func (r *Response) HasMode(mode string) bool {
+	for _, m := range r.Modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+//WatchResponse is returned by /watch when app files changed or waiting timed out
+type WatchResponse struct {
+	Version int64
+	Changed bool
 }
 
 func calcDiff(stripdir, curdir string, req *Request, diffMap DiffMap) error {
@@ -54,7 +95,7 @@ func calcDiff(stripdir, curdir string, req *Request, diffMap DiffMap) error {
 		if err != nil {
 			return nil
 		}
-		newHash := fmt.Sprintf("%x", md5.Sum(content))
+		newHash := HashBytes(req.HashAlgo, content)
 		oldHash, ok := req.Hashes[relPath]
 		if !ok {
 			oldHash = ""
@@ -74,15 +115,93 @@ func calcDiff(stripdir, curdir string, req *Request, diffMap DiffMap) error {
 
 //CalcDiff calcs diffrence on req with cmpdir
 func CalcDiff(cmpdir string, req *Request) (DiffMap, error) {
+	if !SupportedHash(req.HashAlgo) {
+		return nil, fmt.Errorf("unsupported hash algorithm %s", req.HashAlgo)
+	}
 	diffMap := make(DiffMap)
 	cmpdir = normpath(path.Clean(cmpdir))
 	if !strings.HasSuffix(cmpdir, "/") {
 		cmpdir = cmpdir + "/"
 	}
 	err := calcDiff(cmpdir, cmpdir, req, diffMap)
+	if len(req.Scope) > 0 {
+		scope := newScope(req.Scope)
+		for k := range diffMap {
+			if !scope.contains(k) {
+				delete(diffMap, k)
+			}
+		}
+	}
+	if err == nil && req.ClientVersion >= 3 {
+		detectCopies(req, diffMap)
+	}
 	return diffMap, err
 }
 
+//detectCopies marks new files whose content already exists at another client path
+func detectCopies(req *Request, diffMap DiffMap) {
+	sources := make(map[string]string)
+	for k, v := range req.Hashes {
+		if src, ok := sources[v]; !ok || k < src {
+			sources[v] = k
+		}
+	}
+	for k, d := range diffMap {
+		if src, ok := sources[d.NewHash]; ok && src != k {
+			d.CopyFrom = src
+			diffMap[k] = d
+		}
+	}
+}
+
+//CalcDeleted lists files in req which don't exist in cmpdir
+func CalcDeleted(cmpdir string, req *Request) ([]string, error) {
+	deleted := make([]string, 0)
+	for k := range req.Hashes {
+		fi, err := os.Stat(filepath.Join(cmpdir, filepath.FromSlash(path.Clean("/"+k))))
+		if err == nil && !fi.IsDir() {
+			continue
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		deleted = append(deleted, k)
+	}
+	sort.Strings(deleted)
+	return deleted, nil
+}
+
+//a delta carrying more than maxDeltaLiteral of its file as is gains little over downloading the file
+const maxDeltaLiteral = 0.5
+
+//CalcDeltas calcs deltas for files in rootdir which req carries signatures of.
+//files changed too much get no delta, they are downloaded compressed and resumable instead
+func CalcDeltas(rootdir string, req *Request) (map[string]*Delta, error) {
+	deltas := make(map[string]*Delta)
+	for name, sig := range req.Signatures {
+		fpath := filepath.Join(rootdir, filepath.FromSlash(path.Clean("/"+name)))
+		fr, err := os.Open(fpath)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := fr.Stat()
+		if err != nil {
+			fr.Close()
+			return nil, err
+		}
+		delta, err := MakeDelta(sig, bufio.NewReader(fr))
+		fr.Close()
+		if err != nil {
+			return nil, fmt.Errorf("make delta of %s err:%v", name, err)
+		}
+		if float64(delta.LiteralSize()) > maxDeltaLiteral*float64(fi.Size()) {
+			continue
+		}
+		deltas[name] = delta
+	}
+	return deltas, nil
+}
+
 func CalcDiffOnFolders(cmpfrom string, cmpto string) (DiffMap, error) {
 	//calc request on cmpfrom
 	req, err := MakeRequest(cmpto, nil, true)
@@ -94,37 +213,116 @@ func CalcDiffOnFolders(cmpfrom string, cmpto string) (DiffMap, error) {
 
 //PrepareDiff
 func PrepareDiff(rootdir string, cachedir string, diff DiffMap) (string, error) {
-	//concat hash
-	d := md5.New()
-	for _, v := range diff {
-		d.Write([]byte(v.NewHash))
-	}
-	fname := fmt.Sprintf("%x", d.Sum(nil))
-	fname = path.Join(cachedir, fmt.Sprintf("%s.tar.gz", fname))
-	_, err := os.Stat(fname)
-	if err == nil || os.IsExist(err) {
-		//cache exists
+	return PrepareDiffWithOptions(rootdir, cachedir, diff, PatchOptions{Codec: CodecGzip})
+}
+
+//PatchOptions controls how patches are written
+type PatchOptions struct {
+	//App is the app of the patch, patches of apps are kept apart
+	App   string
+	Codec string
+	//NoCompress lists extensions of files stored without compressing, DefaultNoCompress if empty
+	NoCompress []string
+}
+
+//patchEntry is a file of a patch
+type patchEntry struct {
+	name string
+	raw  bool
+}
+
+//patchBuild is a patch being written, waiters get err after done is closed
+type patchBuild struct {
+	done chan struct{}
+	err  error
+}
+
+var (
+	//patches being written by path
+	patchBuilds   = make(map[string]*patchBuild)
+	patchBuildsMu sync.Mutex
+)
+
+//PrepareDiffWithOptions writes files of diff into a tar compressed with opts.Codec.
+//files compressed already are stored raw in members of their own.
+//a patch is written into a temp file and renamed when complete, concurrent calls for the same patch
+//wait for the one writing it
+func PrepareDiffWithOptions(rootdir string, cachedir string, diff DiffMap, opts PatchOptions) (string, error) {
+	codec := opts.Codec
+	if !SupportedCodec(codec) {
+		return "", fmt.Errorf("unsupported codec %s", codec)
+	}
+	//patches are named after the files they hold, checked by the manifest stored next to them
+	manifest := newPatchManifest(opts.App, diff, codec)
+	fname := path.Join(cachedir, manifest.key()+CodecExt(codec))
+	cached := func() bool {
+		m, err := CheckPatch(fname)
+		return err == nil && m.same(manifest)
+	}
+	if cached() {
 		return fname, nil
 	}
 
-	//tar && gzip
+	patchBuildsMu.Lock()
+	if b, ok := patchBuilds[fname]; ok {
+		patchBuildsMu.Unlock()
+		<-b.done
+		return fname, b.err
+	}
+	b := &patchBuild{done: make(chan struct{})}
+	patchBuilds[fname] = b
+	patchBuildsMu.Unlock()
+
+	//the patch may be completed after the check above
+	if !cached() {
+		b.err = writePatch(rootdir, fname, diff, manifest, opts)
+	}
+
+	patchBuildsMu.Lock()
+	delete(patchBuilds, fname)
+	patchBuildsMu.Unlock()
+	close(b.done)
+	return fname, b.err
+}
+
+//writePatch writes the patch into a temp file and renames it to fname, then saves its manifest
+func writePatch(rootdir string, fname string, diff DiffMap, manifest *PatchManifest, opts PatchOptions) error {
+	//sniff files, raw ones are written last so they share one member
+	entries := make([]patchEntry, 0, len(diff))
+	for k := range diff {
+		raw, err := sniffIncompressible(path.Join(rootdir, k), opts.NoCompress)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, patchEntry{name: k, raw: raw})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].raw != entries[j].raw {
+			return !entries[i].raw
+		}
+		return entries[i].name < entries[j].name
+	})
+
+	//tar && compress
 	// file write
 	os.MkdirAll(filepath.Dir(fname), 777)
-	fw, err := os.Create(fname)
+	fw, err := ioutil.TempFile(filepath.Dir(fname), "."+filepath.Base(fname)+".tmp")
 	if err != nil {
-		return "", err
+		return err
 	}
+	tmpname := fw.Name()
+	defer os.Remove(tmpname)
 	defer fw.Close()
 
-	// gzip write
-	gw := gzip.NewWriter(fw)
-	defer gw.Close()
+	// compress write, hashing the archive for its manifest
+	h := sha256.New()
+	mw := &memberWriter{w: io.MultiWriter(fw, h), codec: opts.Codec}
 
 	// tar write
-	tw := tar.NewWriter(gw)
-	defer tw.Close()
+	tw := tar.NewWriter(mw)
 
-	for k, v := range diff {
+	for _, e := range entries {
+		k, v := e.name, diff[e.name]
 		//fmt.Printf("write %s size:%d\n", k, v.NewSize)
 		fpath := path.Join(rootdir, k)
 		h := new(tar.Header)
@@ -135,20 +333,73 @@ func PrepareDiff(rootdir string, cachedir string, diff DiffMap) (string, error)
 		//fmt.Printf("write %s\n", fpath)
 		err = tw.WriteHeader(h)
 		if err != nil {
-			return "", err
+			return err
+		}
+		if err = mw.setRaw(e.raw); err != nil {
+			return err
 		}
 		fr, err := os.Open(fpath)
 		if err != nil {
-			return "", err
+			return err
 		}
 		n, err := io.Copy(tw, fr)
+		fr.Close()
 		if err != nil {
 			fmt.Printf("write bytes:%d, err %v\n", n, err)
-			return "", err
+			return err
 		}
 	}
 
-	return fname, nil
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	if err = mw.Close(); err != nil {
+		return err
+	}
+	if err = fw.Close(); err != nil {
+		return err
+	}
+	fi, err := os.Stat(tmpname)
+	if err != nil {
+		return err
+	}
+	//temp files are private, patches are readable as files created by os.Create
+	os.Chmod(tmpname, 0644)
+	manifest.Size = fi.Size()
+	manifest.Hash = fmt.Sprintf("%x", h.Sum(nil))
+	mtmpname, err := manifest.writeTemp(fname)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(mtmpname)
+	//renamed over any patch in place without removing it first, the manifest last,
+	//so a manifest never goes missing and never passes for other contents
+	if err = os.Rename(tmpname, fname); err != nil {
+		return err
+	}
+	if err = os.Rename(mtmpname, PatchManifestPath(fname)); err != nil {
+		return err
+	}
+	//hashed while written, it needn't be read again to be checked
+	if fi, err = os.Stat(fname); err == nil {
+		markVerified(fname, fi, manifest.Hash)
+	}
+	return nil
+}
+
+//sniffIncompressible reports whether file fpath is compressed already
+func sniffIncompressible(fpath string, exts []string) (bool, error) {
+	fr, err := os.Open(fpath)
+	if err != nil {
+		return false, err
+	}
+	defer fr.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(fr, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	return Incompressible(fpath, head[:n], exts), nil
 }
 
 func ReplaceFile(src []byte, dst string, mode os.FileMode, modTime time.Time) error {
@@ -180,16 +431,103 @@ func ReplaceFile(src []byte, dst string, mode os.FileMode, modTime time.Time) er
 	return nil
 }
 
+//readLocalCopies reads sources of diffs which can be copied from other files in applydir
+func readLocalCopies(applydir string, diff DiffMap, algo string) map[string][]byte {
+	contents := make(map[string][]byte)
+	for k, d := range diff {
+		if len(d.CopyFrom) == 0 {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(applydir, filepath.FromSlash(d.CopyFrom)))
+		if err != nil || HashBytes(algo, content) != d.NewHash {
+			//source was changed, leave it to be downloaded
+			continue
+		}
+		contents[k] = content
+	}
+	return contents
+}
+
+//CopyLocalFiles applies diffs which can be copied from other files in applydir.
+//all sources are read before any file is written, so files may swap names.
+//algo is the hash algorithm of the diff
+func CopyLocalFiles(applydir string, diff DiffMap, algo string) ([]string, error) {
+	contents := readLocalCopies(applydir, diff, algo)
+	copies := make([]string, 0)
+	for k, content := range contents {
+		d := diff[k]
+		if err := ReplaceFile(content, filepath.Join(applydir, k), d.Mode, d.ModTime); err != nil {
+			return copies, err
+		}
+		copies = append(copies, k)
+	}
+	sort.Strings(copies)
+	return copies, nil
+}
+
+//PatchFile rebuilds dst from its current content and delta, checks the result against newHash of algo and replaces dst
+func PatchFile(delta *Delta, dst string, newHash string, algo string, mode os.FileMode, modTime time.Time) error {
+	fr, err := os.Open(dst)
+	if err != nil {
+		return err
+	}
+	content, err := ApplyDelta(fr, delta)
+	fr.Close()
+	if err != nil {
+		return err
+	}
+	if hash := HashBytes(algo, content); hash != newHash {
+		return fmt.Errorf("patch %s hash check failed. expect %s, got %s", dst, newHash, hash)
+	}
+	return ReplaceFile(content, dst, mode, modTime)
+}
+
+//RemoveFiles removes files from applydir except those matching ignore patterns,
+//and then removes directories left empty
+func RemoveFiles(applydir string, files []string, ignore []string) ([]string, error) {
+	removes := make([]string, 0)
+	root := filepath.Clean(applydir)
+	for _, name := range files {
+		name = path.Clean("/" + normpath(name))[1:]
+		skip := false
+		for _, pattern := range ignore {
+			if match, err := filepath.Match(pattern, name); err == nil && match {
+				skip = true
+				break
+			}
+		}
+		if skip || len(name) == 0 {
+			continue
+		}
+		fpath := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.Remove(fpath); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return removes, err
+		}
+		removes = append(removes, fpath)
+
+		//remove empty parent directories
+		for dir := filepath.Dir(fpath); len(dir) > len(root); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+	return removes, nil
+}
+
 func ApplyDiff(applydir string, df io.Reader, diff DiffMap, ignore []string) ([]string, error) {
 	updates := make([]string, 0)
-	// gzip reader
-	gr, err := gzip.NewReader(df)
+	// decompress reader
+	cr, _, err := DetectCodec(df)
 	if err != nil {
 		return updates, err
 	}
-	defer gr.Close()
+	defer cr.Close()
 	// tar reader
-	tr := tar.NewReader(gr)
+	tr := tar.NewReader(cr)
 	//clean path
 	for i, s := range ignore {
 		ignore[i] = strings.Replace(filepath.Clean(s), "\\", "/", -1)
@@ -0,0 +1,201 @@
+package gsync
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//manifestTimeFile keeps the timestamp of the last manifest applied to an app dir
+const manifestTimeFile = "manifest.time"
+
+//ManifestFile describes a released file
+type ManifestFile struct {
+	Path   string
+	SHA256 string
+	Size   int64
+	Mode   os.FileMode
+}
+
+//Manifest lists all files of an app release
+type Manifest struct {
+	App     string
+	Release string
+	Files   []ManifestFile
+	//Timestamp is when the manifest was signed in unix nanoseconds, clients never go back to older ones
+	Timestamp int64
+
+	index map[string]int
+}
+
+//SignedManifest is a manifest in json with its ed25519 signature
+type SignedManifest struct {
+	Manifest  []byte
+	Signature []byte
+}
+
+//MakeManifest describes files under dir
+func MakeManifest(app string, release string, dir string) (*Manifest, error) {
+	m := &Manifest{App: app, Release: release, Files: make([]ManifestFile, 0)}
+	dir = filepath.Clean(dir)
+	err := filepath.Walk(dir, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		fr, err := os.Open(fpath)
+		if err != nil {
+			return err
+		}
+		defer fr.Close()
+		h := sha256.New()
+		if _, err = io.Copy(h, fr); err != nil {
+			return err
+		}
+		m.Files = append(m.Files, ManifestFile{
+			Path:   normpath(strings.TrimPrefix(fpath, dir+string(filepath.Separator))),
+			SHA256: fmt.Sprintf("%x", h.Sum(nil)),
+			Size:   info.Size(),
+			Mode:   info.Mode(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Path < m.Files[j].Path })
+	return m, nil
+}
+
+//Sign stamps the manifest with the current time and signs it with key
+func (m *Manifest) Sign(key ed25519.PrivateKey) (*SignedManifest, error) {
+	m.Timestamp = time.Now().UnixNano()
+	content, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedManifest{
+		Manifest:  content,
+		Signature: ed25519.Sign(key, content),
+	}, nil
+}
+
+//Verify checks the signature of sm with pub and returns the manifest
+func (sm *SignedManifest) Verify(pub ed25519.PublicKey) (*Manifest, error) {
+	if !ed25519.Verify(pub, sm.Manifest, sm.Signature) {
+		return nil, fmt.Errorf("manifest signature verification failed")
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(sm.Manifest, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+//Lookup finds file name in the manifest
+func (m *Manifest) Lookup(name string) (ManifestFile, bool) {
+	if m.index == nil {
+		m.index = make(map[string]int)
+		for i, f := range m.Files {
+			m.index[f.Path] = i
+		}
+	}
+	i, ok := m.index[normpath(name)]
+	if !ok {
+		return ManifestFile{}, false
+	}
+	return m.Files[i], true
+}
+
+//Check verifies content and mode of file name against the manifest
+func (m *Manifest) Check(name string, content []byte, mode os.FileMode) error {
+	f, ok := m.Lookup(name)
+	if !ok {
+		return fmt.Errorf("file %s is not in manifest", name)
+	}
+	if int64(len(content)) != f.Size {
+		return fmt.Errorf("file %s size check failed. expect %d, got %d", name, f.Size, len(content))
+	}
+	if hash := fmt.Sprintf("%x", sha256.Sum256(content)); hash != f.SHA256 {
+		return fmt.Errorf("file %s sha256 check failed. expect %s, got %s", name, f.SHA256, hash)
+	}
+	if mode != f.Mode {
+		return fmt.Errorf("file %s mode check failed. expect %v, got %v", name, f.Mode, mode)
+	}
+	return nil
+}
+
+//CheckTimestamp rejects the manifest if it is older than the last one applied to applydir,
+//so a replayed old manifest can't downgrade the app
+func (m *Manifest) CheckTimestamp(applydir string) error {
+	if last := lastManifestTime(applydir); m.Timestamp < last {
+		return fmt.Errorf("manifest signed at %v is older than the last applied one signed at %v",
+			time.Unix(0, m.Timestamp), time.Unix(0, last))
+	}
+	return nil
+}
+
+func lastManifestTime(applydir string) int64 {
+	content, err := ioutil.ReadFile(filepath.Join(applydir, StateDir, manifestTimeFile))
+	if err != nil {
+		return 0
+	}
+	ts, _ := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	return ts
+}
+
+func saveManifestTime(applydir string, ts int64) error {
+	if ts <= lastManifestTime(applydir) {
+		return nil
+	}
+	return ioutil.WriteFile(filepath.Join(applydir, StateDir, manifestTimeFile), []byte(strconv.FormatInt(ts, 10)), 0666)
+}
+
+//GenerateKey creates an ed25519 key pair encoded in base64
+func GenerateKey() (string, string, error) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(pub), base64.StdEncoding.EncodeToString(key.Seed()), nil
+}
+
+//ParsePrivateKey decodes a base64 ed25519 private key or seed
+func ParsePrivateKey(s string) (ed25519.PrivateKey, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	switch len(b) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(b), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(b), nil
+	}
+	return nil, fmt.Errorf("invalid private key size %d", len(b))
+}
+
+//ParsePublicKey decodes a base64 ed25519 public key
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key size %d", len(b))
+	}
+	return ed25519.PublicKey(b), nil
+}
@@ -0,0 +1,189 @@
+package gsync
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+//TreeNode is a child of a dir in a merkle tree, names of sub dirs end with "/"
+type TreeNode struct {
+	Name string
+	Hash string
+}
+
+//TreeRequest asks for children of Dirs in the merkle tree of an app
+type TreeRequest struct {
+	HashAlgo string
+	Release  string `json:",omitempty"`
+	Dirs     []string
+}
+
+//TreeResponse holds children of the requested dirs. dirs not on the server have none
+type TreeResponse struct {
+	Release string `json:",omitempty"`
+	Dirs    map[string][]TreeNode
+}
+
+//MerkleTree hashes files(path → file hash) as a directory tree
+type MerkleTree struct {
+	files map[string]string
+	//children of each dir, the root dir is ""
+	children map[string][]string
+	dirs     map[string]string
+}
+
+//NewMerkleTree hashes files with algo
+func NewMerkleTree(files map[string]string, algo string) *MerkleTree {
+	m := &MerkleTree{
+		files:    files,
+		children: map[string][]string{"": nil},
+		dirs:     make(map[string]string),
+	}
+	for k := range files {
+		name := k
+		for {
+			dir := path.Dir(name)
+			if dir == "." {
+				dir = ""
+			}
+			child := path.Base(name)
+			if name != k {
+				child += "/"
+			}
+			_, seen := m.children[dir]
+			m.children[dir] = append(m.children[dir], child)
+			if seen || len(dir) == 0 {
+				break
+			}
+			name = dir
+		}
+	}
+
+	dirs := make([]string, 0, len(m.children))
+	for dir := range m.children {
+		dirs = append(dirs, dir)
+	}
+	depth := func(dir string) int {
+		if len(dir) == 0 {
+			return -1
+		}
+		return strings.Count(dir, "/")
+	}
+	//deepest dirs first, so sub dirs are hashed before their parents
+	sort.Slice(dirs, func(i, j int) bool { return depth(dirs[i]) > depth(dirs[j]) })
+	for _, dir := range dirs {
+		sort.Strings(m.children[dir])
+		var b strings.Builder
+		for _, node := range m.Children(dir) {
+			b.WriteString(node.Name)
+			b.WriteByte(0)
+			b.WriteString(node.Hash)
+			b.WriteByte('\n')
+		}
+		m.dirs[dir] = HashBytes(algo, []byte(b.String()))
+	}
+	return m
+}
+
+//Root returns the root hash
+func (m *MerkleTree) Root() string {
+	return m.dirs[""]
+}
+
+//Children lists children of dir with their hashes, sorted by name
+func (m *MerkleTree) Children(dir string) []TreeNode {
+	names := m.children[dir]
+	nodes := make([]TreeNode, 0, len(names))
+	for _, name := range names {
+		child := path.Join(dir, name)
+		if strings.HasSuffix(name, "/") {
+			nodes = append(nodes, TreeNode{Name: name, Hash: m.dirs[child]})
+		} else {
+			nodes = append(nodes, TreeNode{Name: name, Hash: m.files[child]})
+		}
+	}
+	return nodes
+}
+
+//Compare compares children of dir with remote ones. it returns sub dirs differing on both sides
+//to descend into, and paths differing entirely. dirs in the paths end with "/"
+func (m *MerkleTree) Compare(dir string, remote []TreeNode) ([]string, []string) {
+	var descend, scope []string
+	local := make(map[string]string)
+	for _, node := range m.Children(dir) {
+		local[node.Name] = node.Hash
+	}
+	for _, node := range remote {
+		hash, ok := local[node.Name]
+		delete(local, node.Name)
+		if ok && hash == node.Hash {
+			continue
+		}
+		if ok && strings.HasSuffix(node.Name, "/") {
+			descend = append(descend, path.Join(dir, node.Name))
+			continue
+		}
+		scope = append(scope, scopePath(dir, node.Name))
+	}
+	//paths only the local tree has
+	for name := range local {
+		scope = append(scope, scopePath(dir, name))
+	}
+	sort.Strings(descend)
+	sort.Strings(scope)
+	return descend, scope
+}
+
+func scopePath(dir string, name string) string {
+	if strings.HasSuffix(name, "/") {
+		return path.Join(dir, name) + "/"
+	}
+	return path.Join(dir, name)
+}
+
+//Files returns files in scope
+func (m *MerkleTree) Files(scope []string) map[string]string {
+	set := newScope(scope)
+	files := make(map[string]string)
+	for k, v := range m.files {
+		if set.contains(k) {
+			files[k] = v
+		}
+	}
+	return files
+}
+
+//scopeSet holds paths of a scope, dirs end with "/"
+type scopeSet map[string]bool
+
+func newScope(scope []string) scopeSet {
+	set := make(scopeSet)
+	for _, p := range scope {
+		set[p] = true
+	}
+	return set
+}
+
+//contains reports whether file name is in the scope or under a dir of it
+func (s scopeSet) contains(name string) bool {
+	if s[name] {
+		return true
+	}
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if s[dir+"/"] {
+			return true
+		}
+	}
+	return false
+}
+
+//MerkleDirs returns hashes of all dirs holding files, the root dir is ""
+func MerkleDirs(files map[string]string, algo string) map[string]string {
+	return NewMerkleTree(files, algo).dirs
+}
+
+//MerkleRoot returns the root hash of files as a directory tree
+func MerkleRoot(files map[string]string, algo string) string {
+	return NewMerkleTree(files, algo).Root()
+}
@@ -0,0 +1,164 @@
+package gsync
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+)
+
+//DefaultNoCompress lists extensions of files which are compressed already
+var DefaultNoCompress = []string{
+	".zip", ".gz", ".tgz", ".bz2", ".xz", ".zst", ".7z", ".rar", ".jar", ".apk",
+	".png", ".jpg", ".jpeg", ".gif", ".webp",
+	".mp3", ".mp4", ".m4a", ".mkv", ".webm", ".mov", ".avi", ".ogg",
+	".woff", ".woff2",
+}
+
+//content types sniffed as compressed already
+var compressedTypes = []string{
+	"image/png", "image/jpeg", "image/gif", "image/webp",
+	"video/", "audio/mpeg", "application/ogg",
+	"application/zip", "application/x-gzip", "application/x-rar-compressed",
+	"font/woff",
+}
+
+//Incompressible reports whether file name with content starting with head is compressed already.
+//it checks the extension against exts, DefaultNoCompress if exts is empty, and sniffs head
+func Incompressible(name string, head []byte, exts []string) bool {
+	if len(exts) == 0 {
+		exts = DefaultNoCompress
+	}
+	ext := strings.ToLower(path.Ext(name))
+	for _, e := range exts {
+		if ext == strings.ToLower(e) {
+			return true
+		}
+	}
+	if len(head) > 512 {
+		head = head[:512]
+	}
+	if len(head) >= len(zstdMagic) && string(head[:len(zstdMagic)]) == string(zstdMagic) {
+		return true
+	}
+	contentType := http.DetectContentType(head)
+	for _, t := range compressedTypes {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+//memberWriter writes a stream of concatenated compressed members, gzip members or zstd frames,
+//so parts of the stream can be stored without compressing them. decoders read it as one stream
+type memberWriter struct {
+	w     io.Writer
+	codec string
+	cw    io.WriteCloser
+	raw   bool
+}
+
+//setRaw starts a new member if storing raw changes
+func (m *memberWriter) setRaw(raw bool) error {
+	if m.cw != nil && m.raw == raw {
+		return nil
+	}
+	if err := m.Close(); err != nil {
+		return err
+	}
+	m.raw = raw
+	return nil
+}
+
+func (m *memberWriter) Write(p []byte) (int, error) {
+	if m.cw == nil {
+		var err error
+		if m.raw {
+			m.cw, err = newRawWriter(m.w, m.codec)
+		} else {
+			m.cw, err = NewCodecWriter(m.w, m.codec)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return m.cw.Write(p)
+}
+
+func (m *memberWriter) Close() error {
+	if m.cw == nil {
+		return nil
+	}
+	err := m.cw.Close()
+	m.cw = nil
+	return err
+}
+
+//newRawWriter stores writes to w in the format of codec without compressing
+func newRawWriter(w io.Writer, codec string) (io.WriteCloser, error) {
+	switch CodecName(codec) {
+	case CodecGzip:
+		return gzip.NewWriterLevel(w, gzip.NoCompression)
+	case CodecZstd:
+		return &zstdRawWriter{w: w}, nil
+	}
+	return NewCodecWriter(w, codec)
+}
+
+//size of raw blocks in zstd frames, the window size is the same
+const zstdRawBlockSize = 128 << 10
+
+//zstdRawWriter writes a zstd frame of raw blocks
+type zstdRawWriter struct {
+	w       io.Writer
+	buf     []byte
+	started bool
+}
+
+func (z *zstdRawWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		m := zstdRawBlockSize - len(z.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		z.buf = append(z.buf, p[:m]...)
+		p = p[m:]
+		if len(z.buf) == zstdRawBlockSize {
+			if err := z.flush(false); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (z *zstdRawWriter) flush(last bool) error {
+	if !z.started {
+		//frame header without content size and checksum, window descriptor of 128KB
+		header := append(append([]byte{}, zstdMagic...), 0x00, 0x38)
+		if _, err := z.w.Write(header); err != nil {
+			return err
+		}
+		z.started = true
+	}
+	blockHeader := uint32(len(z.buf)) << 3
+	if last {
+		blockHeader |= 1
+	}
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], blockHeader)
+	if _, err := z.w.Write(b[:3]); err != nil {
+		return err
+	}
+	_, err := z.w.Write(z.buf)
+	z.buf = z.buf[:0]
+	return err
+}
+
+func (z *zstdRawWriter) Close() error {
+	return z.flush(true)
+}
@@ -0,0 +1,161 @@
+package gsync
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+//PatchManifestFile describes a file of a patch
+type PatchManifestFile struct {
+	Path string
+	Hash string
+	Mode os.FileMode
+}
+
+//PatchManifest describes a cached patch, it is stored next to the patch
+type PatchManifest struct {
+	App   string
+	Codec string
+	Files []PatchManifestFile
+	//Size and sha256 Hash of the patch archive
+	Size int64
+	Hash string
+}
+
+//PatchManifestPath returns the path of the manifest of patch fname
+func PatchManifestPath(fname string) string {
+	return fname + ".json"
+}
+
+//newPatchManifest describes diff of app, sorted by path
+func newPatchManifest(app string, diff DiffMap, codec string) *PatchManifest {
+	m := &PatchManifest{App: app, Codec: CodecName(codec), Files: make([]PatchManifestFile, 0, len(diff))}
+	for k, v := range diff {
+		m.Files = append(m.Files, PatchManifestFile{Path: k, Hash: v.NewHash, Mode: v.Mode})
+	}
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Path < m.Files[j].Path })
+	return m
+}
+
+//key returns the name of the patch, a hash over app, codec and paths, hashes and modes of its files
+func (m *PatchManifest) key() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\n", m.App, m.Codec)
+	for _, f := range m.Files {
+		fmt.Fprintf(h, "%s\x00%s\x00%o\n", f.Path, f.Hash, uint32(f.Mode))
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)[:16])
+}
+
+//same reports whether o describes the same files as m
+func (m *PatchManifest) same(o *PatchManifest) bool {
+	if m.App != o.App || m.Codec != o.Codec || len(m.Files) != len(o.Files) {
+		return false
+	}
+	for i, f := range m.Files {
+		if f != o.Files[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//writeTemp writes the manifest of patch fname into a temp file next to it, and returns the temp file
+func (m *PatchManifest) writeTemp(fname string) (string, error) {
+	content, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	fw, err := ioutil.TempFile(filepath.Dir(fname), "."+filepath.Base(PatchManifestPath(fname))+".tmp")
+	if err != nil {
+		return "", err
+	}
+	if _, err = fw.Write(content); err != nil {
+		fw.Close()
+		os.Remove(fw.Name())
+		return "", err
+	}
+	if err = fw.Close(); err != nil {
+		os.Remove(fw.Name())
+		return "", err
+	}
+	os.Chmod(fw.Name(), 0644)
+	return fw.Name(), nil
+}
+
+//patchStamp identifies an archive verified against the hash of its manifest
+type patchStamp struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+//most archives remembered verified, all are verified again if there are more
+const maxVerifiedPatches = 4096
+
+var (
+	verifiedPatches   = make(map[string]patchStamp)
+	verifiedPatchesMu sync.Mutex
+)
+
+//markVerified remembers archive fname with fi matches hash, so it isn't hashed again until changed
+func markVerified(fname string, fi os.FileInfo, hash string) {
+	verifiedPatchesMu.Lock()
+	defer verifiedPatchesMu.Unlock()
+	if len(verifiedPatches) >= maxVerifiedPatches {
+		verifiedPatches = make(map[string]patchStamp)
+	}
+	verifiedPatches[fname] = patchStamp{size: fi.Size(), modTime: fi.ModTime(), hash: hash}
+}
+
+func isVerified(fname string, fi os.FileInfo, hash string) bool {
+	verifiedPatchesMu.Lock()
+	defer verifiedPatchesMu.Unlock()
+	stamp, ok := verifiedPatches[fname]
+	return ok && stamp == patchStamp{size: fi.Size(), modTime: fi.ModTime(), hash: hash}
+}
+
+//CheckPatch loads the manifest of patch fname and checks the patch is complete and not changed.
+//the archive is hashed only the first time it is checked after being written or changed
+func CheckPatch(fname string) (*PatchManifest, error) {
+	content, err := ioutil.ReadFile(PatchManifestPath(fname))
+	if err != nil {
+		return nil, err
+	}
+	m := new(PatchManifest)
+	if err = json.Unmarshal(content, m); err != nil {
+		return nil, fmt.Errorf("parse patch manifest err:%v", err)
+	}
+	fr, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fr.Close()
+	fi, err := fr.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() != m.Size {
+		return nil, fmt.Errorf("patch size %d, expect %d", fi.Size(), m.Size)
+	}
+	if isVerified(fname, fi, m.Hash) {
+		return m, nil
+	}
+	h := sha256.New()
+	if _, err = io.Copy(h, fr); err != nil {
+		return nil, err
+	}
+	if hash := fmt.Sprintf("%x", h.Sum(nil)); hash != m.Hash {
+		return nil, fmt.Errorf("patch hash %s, expect %s", hash, m.Hash)
+	}
+	markVerified(fname, fi, m.Hash)
+	return m, nil
+}
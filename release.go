@@ -0,0 +1,135 @@
+package gsync
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//ReleasesDir is the sub directory of an app dir holding immutable releases
+const ReleasesDir = "releases"
+
+//CurrentFile is the file of an app dir pointing to the current release
+const CurrentFile = "current"
+
+//CurrentRelease returns id and directory of the current release of appdir.
+//if appdir doesn't use releases, id is empty and dir is appdir itself
+func CurrentRelease(appdir string) (string, string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(appdir, CurrentFile))
+	if os.IsNotExist(err) {
+		return "", appdir, nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	id := strings.TrimSpace(string(content))
+	dir, err := ReleaseDir(appdir, id)
+	if err != nil {
+		return "", "", err
+	}
+	return id, dir, nil
+}
+
+//ReleaseDir returns the directory of release id in appdir
+func ReleaseDir(appdir string, id string) (string, error) {
+	if _, err := strconv.Atoi(id); err != nil {
+		return "", fmt.Errorf("invalid release:%s", id)
+	}
+	dir, err := JoinDir(filepath.Join(appdir, ReleasesDir), id)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("release %s is not a directory", id)
+	}
+	return dir, nil
+}
+
+//Releases lists release ids of appdir in ascending order
+func Releases(appdir string) ([]int, error) {
+	fis, err := ioutil.ReadDir(filepath.Join(appdir, ReleasesDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, fi := range fis {
+		if id, err := strconv.Atoi(fi.Name()); err == nil && fi.IsDir() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+//PublishRelease copies srcdir into a new release of appdir and makes it current
+func PublishRelease(appdir string, srcdir string) (string, error) {
+	ids, err := Releases(appdir)
+	if err != nil {
+		return "", err
+	}
+	next := 1
+	if len(ids) > 0 {
+		next = ids[len(ids)-1] + 1
+	}
+	id := strconv.Itoa(next)
+
+	//copy into a temp dir first, so a half copied release is never visible
+	tmpdir := filepath.Join(appdir, ReleasesDir, "."+id+".tmp")
+	os.RemoveAll(tmpdir)
+	if err = os.MkdirAll(tmpdir, 0777); err != nil {
+		return "", err
+	}
+	if err = copyDir(srcdir, tmpdir, true); err != nil {
+		os.RemoveAll(tmpdir)
+		return "", err
+	}
+	if err = os.Rename(tmpdir, filepath.Join(appdir, ReleasesDir, id)); err != nil {
+		os.RemoveAll(tmpdir)
+		return "", err
+	}
+	return id, SetCurrentRelease(appdir, id)
+}
+
+//SetCurrentRelease points appdir to release id atomically
+func SetCurrentRelease(appdir string, id string) error {
+	if _, err := ReleaseDir(appdir, id); err != nil {
+		return err
+	}
+	tmpfile := filepath.Join(appdir, CurrentFile+".tmp")
+	if err := ioutil.WriteFile(tmpfile, []byte(id), 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmpfile, filepath.Join(appdir, CurrentFile))
+}
+
+//PruneReleases removes all but the newest keep releases. the current release is always kept
+func PruneReleases(appdir string, keep int) error {
+	ids, err := Releases(appdir)
+	if err != nil || keep <= 0 || len(ids) <= keep {
+		return err
+	}
+	current, _, err := CurrentRelease(appdir)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids[:len(ids)-keep] {
+		if strconv.Itoa(id) == current {
+			continue
+		}
+		if err = os.RemoveAll(filepath.Join(appdir, ReleasesDir, strconv.Itoa(id))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,7 +1,6 @@
 package gsync
 
 import (
-	"crypto/md5"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -103,6 +102,19 @@ func copyDir(fromdir string, todir string, overwrite bool) error {
 type Request struct {
 	ClientVersion int
 	Hashes        map[string]string
+	//HashAlgo is the algorithm of Hashes, md5 if empty
+	HashAlgo string `json:",omitempty"`
+	//Release pins the release files are compared with, the current one if empty
+	Release string `json:",omitempty"`
+	//Signatures holds block checksums of files the client wants deltas for
+	Signatures map[string]*Signature `json:",omitempty"`
+	//RootHash is the merkle root of Hashes. a request with RootHash but no Hashes
+	//only checks whether the client is up to date
+	RootHash string `json:",omitempty"`
+	//Scope limits the diff to these paths, dirs end with "/". Hashes holds files in scope only
+	Scope []string `json:",omitempty"`
+	//Codec compresses the patch file: gzip(default), zstd or none
+	Codec string `json:",omitempty"`
 }
 
 func makeRequest(stripdir string, curdir string, req *Request, recursive bool) error {
@@ -116,6 +128,10 @@ func makeRequest(stripdir string, curdir string, req *Request, recursive bool) e
 	for _, fi := range fis {
 		fiPath := normpath(path.Join(curdir, fi.Name()))
 		if fi.IsDir() {
+			if curdir == stripdir && fi.Name() == StateDir {
+				//client state is never synced
+				continue
+			}
 			if recursive {
 				if err = makeRequest(stripdir, fiPath, req, recursive); err != nil {
 					return err
@@ -131,8 +147,23 @@ func makeRequest(stripdir string, curdir string, req *Request, recursive bool) e
 }
 
 func MakeRequest(dir string, ignores []string, recursive bool) (*Request, error) {
+	return MakeRequestWithHash(dir, ignores, recursive, HashMD5)
+}
+
+//MakeRequestWithHash makes a request hashing files with algo
+func MakeRequestWithHash(dir string, ignores []string, recursive bool, algo string) (*Request, error) {
+	return MakeRequestWithIndex(dir, ignores, recursive, algo, nil)
+}
+
+//MakeRequestWithIndex makes a request hashing only files changed since they were put into idx.
+//idx is updated to files of dir, all files are hashed if idx is nil
+func MakeRequestWithIndex(dir string, ignores []string, recursive bool, algo string, idx *HashIndex) (*Request, error) {
+	if !SupportedHash(algo) {
+		return nil, fmt.Errorf("unsupported hash algorithm %s", algo)
+	}
 	req := &Request{
-		Hashes: make(map[string]string),
+		Hashes:   make(map[string]string),
+		HashAlgo: HashName(algo),
 	}
 	dir = normpath(path.Clean(dir))
 	if !strings.HasSuffix(dir, "/") {
@@ -151,13 +182,24 @@ func MakeRequest(dir string, ignores []string, recursive bool) (*Request, error)
 	}
 
 	//calc hash
+	algo = HashName(algo)
+	if idx != nil {
+		files := make(map[string]*IndexEntry)
+		for k := range req.Hashes {
+			if req.Hashes[k], err = idx.hashFile(dir, k, algo, files); err != nil {
+				return nil, err
+			}
+		}
+		idx.Files = files
+		return req, nil
+	}
 	for k := range req.Hashes {
 		fname := filepath.Join(dir, k)
 		contents, err := ioutil.ReadFile(fname)
 		if err != nil {
 			return nil, fmt.Errorf("read file %s err:%v", fname, err)
 		}
-		req.Hashes[k] = fmt.Sprintf("%x", md5.Sum(contents))
+		req.Hashes[k] = HashBytes(algo, contents)
 	}
 
 	return req, err
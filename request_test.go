@@ -4,11 +4,15 @@ import (
 	"bytes"
 	"crypto/md5"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -268,3 +272,1082 @@ func TestDebounceChan(t *testing.T) {
 
 	log.Printf("sum=%d", sum)
 }
+
+func Test_Delta(t *testing.T) {
+	old := make([]byte, 200*1024)
+	rand.New(rand.NewSource(1)).Read(old)
+
+	//modify some bytes, insert and remove a few
+	content := append([]byte{}, old[:50000]...)
+	content = append(content, []byte("inserted bytes")...)
+	content = append(content, old[50000:120000]...)
+	content = append(content, old[120100:]...)
+	content[150000] ^= 0xff
+
+	sig, err := MakeSignature(bytes.NewReader(old), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta, err := MakeDelta(sig, bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var literal int
+	for _, op := range delta.Ops {
+		literal += len(op.Data)
+	}
+	if literal > 4*DefaultBlockSize {
+		t.Fatalf("delta too large: %d literal bytes", literal)
+	}
+
+	patched, err := ApplyDelta(bytes.NewReader(old), delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(patched, content) {
+		t.Fatal("patched content not equal")
+	}
+}
+
+func Test_CalcDeltasFallback(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "gsync.")
+	defer os.RemoveAll(dir)
+	rnd := rand.New(rand.NewSource(1))
+	old := make([]byte, 100*1024)
+	rnd.Read(old)
+	//similar keeps most blocks, rewritten keeps none
+	similar := append(append([]byte{}, old[:90*1024]...), []byte("appended")...)
+	rewritten := make([]byte, len(old))
+	rnd.Read(rewritten)
+	ioutil.WriteFile(filepath.Join(dir, "similar.bin"), similar, 0666)
+	ioutil.WriteFile(filepath.Join(dir, "rewritten.bin"), rewritten, 0666)
+
+	sig, err := MakeSignature(bytes.NewReader(old), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &Request{Signatures: map[string]*Signature{"similar.bin": sig, "rewritten.bin": sig}}
+	deltas, err := CalcDeltas(dir, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := deltas["rewritten.bin"]; ok {
+		t.Fatal("expect no delta of rewritten file, it is downloaded instead")
+	}
+	delta, ok := deltas["similar.bin"]
+	if !ok {
+		t.Fatal("expect delta of similar file")
+	}
+	patched, err := ApplyDelta(bytes.NewReader(old), delta)
+	if err != nil || !bytes.Equal(patched, similar) {
+		t.Fatalf("expect similar file rebuilt, err %v", err)
+	}
+}
+
+func Test_RemoveFiles(t *testing.T) {
+	newdir, err := ioutil.TempDir(os.TempDir(), "gsync.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	olddir, err := ioutil.TempDir(os.TempDir(), "gsync.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wd, _ := os.Getwd()
+	if err = copyDir(filepath.Join(wd, "testdata/new"), newdir, true); err != nil {
+		t.Fatal(err)
+	}
+	if err = copyDir(filepath.Join(wd, "testdata/old"), olddir, true); err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(olddir, "extra"), 0777)
+	ioutil.WriteFile(filepath.Join(olddir, "extra/4.txt"), []byte("extra"), 0666)
+	ioutil.WriteFile(filepath.Join(olddir, "keep.log"), []byte("log"), 0666)
+
+	req, err := MakeRequest(olddir, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := CalcDeleted(newdir, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 2 || deleted[0] != "extra/4.txt" || deleted[1] != "keep.log" {
+		t.Fatalf("unexpected deleted files:%v", deleted)
+	}
+
+	removes, err := RemoveFiles(olddir, deleted, []string{"*.log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removes) != 1 {
+		t.Fatalf("expect 1 file removed. got %v", removes)
+	}
+	if fexists(filepath.Join(olddir, "extra")) {
+		t.Fatal("empty directory should be removed")
+	}
+	if !fexists(filepath.Join(olddir, "keep.log")) {
+		t.Fatal("ignored file should not be removed")
+	}
+	os.RemoveAll(newdir)
+	os.RemoveAll(olddir)
+}
+
+func Test_CopyLocalFiles(t *testing.T) {
+	newdir, err := ioutil.TempDir(os.TempDir(), "gsync.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	olddir, err := ioutil.TempDir(os.TempDir(), "gsync.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//1.txt and 2.txt swap contents, 3.txt is moved into a sub directory
+	ioutil.WriteFile(filepath.Join(olddir, "1.txt"), []byte("content 1"), 0666)
+	ioutil.WriteFile(filepath.Join(olddir, "2.txt"), []byte("content 2"), 0666)
+	ioutil.WriteFile(filepath.Join(olddir, "3.txt"), []byte("content 3"), 0666)
+	os.MkdirAll(filepath.Join(newdir, "sub"), 0777)
+	ioutil.WriteFile(filepath.Join(newdir, "1.txt"), []byte("content 2"), 0666)
+	ioutil.WriteFile(filepath.Join(newdir, "2.txt"), []byte("content 1"), 0666)
+	ioutil.WriteFile(filepath.Join(newdir, "sub/3.txt"), []byte("content 3"), 0666)
+
+	req, err := MakeRequest(olddir, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ClientVersion = 3
+	diffMap, err := CalcDiff(newdir, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffMap["sub/3.txt"].CopyFrom != "3.txt" || diffMap["1.txt"].CopyFrom != "2.txt" {
+		t.Fatalf("copies not detected: %#v", diffMap)
+	}
+
+	copies, err := CopyLocalFiles(olddir, diffMap, HashMD5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(copies) != 3 {
+		t.Fatalf("expect 3 copies. got %v", copies)
+	}
+	diffMap, err = CalcDiffOnFolders(newdir, olddir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffMap) != 0 {
+		t.Fatalf("copy failed. there're differences:%#v", diffMap)
+	}
+	os.RemoveAll(newdir)
+	os.RemoveAll(olddir)
+}
+
+func Test_PublishRelease(t *testing.T) {
+	appdir, err := ioutil.TempDir(os.TempDir(), "gsync.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, dir, err := CurrentRelease(appdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "" || dir != appdir {
+		t.Fatalf("expect app dir without releases. got %s %s", id, dir)
+	}
+
+	wd, _ := os.Getwd()
+	for _, expect := range []string{"1", "2"} {
+		id, err = PublishRelease(appdir, filepath.Join(wd, "testdata/new"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != expect {
+			t.Fatalf("expect release %s. got %s", expect, id)
+		}
+	}
+
+	id, dir, err = CurrentRelease(appdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "2" {
+		t.Fatalf("expect current release 2. got %s", id)
+	}
+	diffMap, err := CalcDiffOnFolders(dir, filepath.Join(wd, "testdata/new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffMap) != 0 {
+		t.Fatalf("release not equal to published dir:%#v", diffMap)
+	}
+
+	if err = PruneReleases(appdir, 1); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := Releases(appdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != 2 {
+		t.Fatalf("unexpected releases after prune:%v", ids)
+	}
+	os.RemoveAll(appdir)
+}
+
+func Test_Rollback(t *testing.T) {
+	appdir, err := ioutil.TempDir(os.TempDir(), "gsync.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2016, 6, 28, 10, 29, 34, 0, time.Local)
+	ioutil.WriteFile(filepath.Join(appdir, "1.txt"), []byte("old content"), 0600)
+	os.Chtimes(filepath.Join(appdir, "1.txt"), modTime, modTime)
+	ioutil.WriteFile(filepath.Join(appdir, "2.txt"), []byte("removed"), 0666)
+
+	backup, err := BeginBackup(appdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"1.txt", "2.txt", "sub/3.txt"} {
+		if err = backup.Save(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ReplaceFile([]byte("new content"), filepath.Join(appdir, "1.txt"), 0666, time.Now())
+	ReplaceFile([]byte("created"), filepath.Join(appdir, "sub/3.txt"), 0666, time.Now())
+	os.Remove(filepath.Join(appdir, "2.txt"))
+	if err = backup.Commit(5); err != nil {
+		t.Fatal(err)
+	}
+
+	//state dir should never be synced
+	req, err := MakeRequest(appdir, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(req.Hashes) != 2 {
+		t.Fatalf("expect 2 files. got %v", req.Hashes)
+	}
+
+	if _, err = Rollback(appdir, 1); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(appdir, "1.txt"))
+	if err != nil || string(content) != "old content" {
+		t.Fatalf("1.txt not restored: %s %v", content, err)
+	}
+	fi, err := os.Stat(filepath.Join(appdir, "1.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode() != 0600 || !fi.ModTime().Equal(modTime) {
+		t.Fatalf("mode or mtime not restored: %v %v", fi.Mode(), fi.ModTime())
+	}
+	if !fexists(filepath.Join(appdir, "2.txt")) {
+		t.Fatal("2.txt not restored")
+	}
+	if fexists(filepath.Join(appdir, "sub")) {
+		t.Fatal("created files should be removed")
+	}
+	backups, err := Backups(appdir)
+	if err != nil || len(backups) != 0 {
+		t.Fatalf("backup should be removed after rollback: %v %v", backups, err)
+	}
+	os.RemoveAll(appdir)
+}
+
+func Test_Transaction(t *testing.T) {
+	appdir, err := ioutil.TempDir(os.TempDir(), "gsync.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(appdir, "1.txt"), []byte("old content"), 0666)
+	ioutil.WriteFile(filepath.Join(appdir, "2.txt"), []byte("removed"), 0666)
+	newContent := []byte("new content")
+	diff := Diff{NewHash: fmt.Sprintf("%x", md5.Sum(newContent)), Mode: 0666, ModTime: time.Now()}
+
+	tx, err := BeginTransaction(appdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Stage("1.txt", []byte("corrupted"), diff); err == nil {
+		t.Fatal("stage should check file hash")
+	}
+	if err = tx.Stage("1.txt", newContent, diff); err != nil {
+		t.Fatal(err)
+	}
+	tx.Remove([]string{"2.txt"}, nil)
+	content, _ := ioutil.ReadFile(filepath.Join(appdir, "1.txt"))
+	if string(content) != "old content" {
+		t.Fatal("staged file should not be applied before commit")
+	}
+	if _, err = tx.Commit(5); err != nil {
+		t.Fatal(err)
+	}
+	content, _ = ioutil.ReadFile(filepath.Join(appdir, "1.txt"))
+	if string(content) != "new content" || fexists(filepath.Join(appdir, "2.txt")) {
+		t.Fatal("transaction not applied")
+	}
+
+	//an update interrupted after journal was written is completed
+	ioutil.WriteFile(filepath.Join(appdir, "1.txt"), []byte("old content"), 0666)
+	tx, _ = BeginTransaction(appdir)
+	tx.Stage("1.txt", newContent, diff)
+	backup, _ := BeginBackup(appdir)
+	backup.Save("1.txt")
+	tx.Backup = backup.ID
+	tx.writeJournal()
+	recovered, err := RecoverTransaction(appdir, 5)
+	if err != nil || !recovered {
+		t.Fatalf("expect recovered. got %v %v", recovered, err)
+	}
+	content, _ = ioutil.ReadFile(filepath.Join(appdir, "1.txt"))
+	if string(content) != "new content" {
+		t.Fatal("interrupted transaction not completed")
+	}
+
+	//an update without staged files is reverted
+	ioutil.WriteFile(filepath.Join(appdir, "1.txt"), []byte("old content"), 0666)
+	tx, _ = BeginTransaction(appdir)
+	tx.Stage("1.txt", newContent, diff)
+	backup, _ = BeginBackup(appdir)
+	backup.Save("1.txt")
+	tx.Backup = backup.ID
+	tx.writeJournal()
+	ioutil.WriteFile(filepath.Join(appdir, "1.txt"), []byte("half written"), 0666)
+	tx.Abort()
+	if recovered, err = RecoverTransaction(appdir, 5); err != nil || !recovered {
+		t.Fatalf("expect recovered. got %v %v", recovered, err)
+	}
+	content, _ = ioutil.ReadFile(filepath.Join(appdir, "1.txt"))
+	if string(content) != "old content" {
+		t.Fatal("interrupted transaction not reverted")
+	}
+	if fexists(filepath.Join(appdir, StateDir, journalFile)) {
+		t.Fatal("journal should be removed after recovery")
+	}
+	os.RemoveAll(appdir)
+}
+
+func Test_Manifest(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "gsync.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(dir, "sub"), 0777)
+	ioutil.WriteFile(filepath.Join(dir, "1.txt"), []byte("1"), 0666)
+	ioutil.WriteFile(filepath.Join(dir, "sub", "2.txt"), []byte("2"), 0666)
+	fi, _ := os.Stat(filepath.Join(dir, "sub", "2.txt"))
+
+	pub, key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, _ := ParsePublicKey(pub)
+	privKey, _ := ParsePrivateKey(key)
+	m, err := MakeManifest("app", "1", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm, err := m.Sign(privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = sm.Verify(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Files) != 2 || m.Files[1].Path != "sub/2.txt" {
+		t.Fatalf("unexpected manifest files %v", m.Files)
+	}
+	if err = m.Check("sub/2.txt", []byte("2"), fi.Mode()); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Check("sub/2.txt", []byte("3"), fi.Mode()); err == nil {
+		t.Fatal("check should fail on changed content")
+	}
+	if err = m.Check("3.txt", []byte("2"), fi.Mode()); err == nil {
+		t.Fatal("check should fail on file not in manifest")
+	}
+
+	sm.Manifest = bytes.Replace(sm.Manifest, []byte(`"Release":"1"`), []byte(`"Release":"2"`), 1)
+	if _, err = sm.Verify(pubKey); err == nil {
+		t.Fatal("verify should fail on tampered manifest")
+	}
+
+	//once a newer manifest is applied, replaying the older one is rejected
+	old := m
+	if old.Timestamp == 0 {
+		t.Fatal("expect manifest signed with timestamp")
+	}
+	newer, _ := MakeManifest("app", "", dir)
+	sm, _ = newer.Sign(privKey)
+	newer, _ = sm.Verify(pubKey)
+	appdir, _ := ioutil.TempDir(os.TempDir(), "gsync.")
+	defer os.RemoveAll(appdir)
+	if err = old.CheckTimestamp(appdir); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := BeginTransaction(appdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.HashAlgo = HashSHA256
+	tx.Manifest = newer
+	if err = tx.Stage("1.txt", []byte("1"), Diff{NewHash: HashBytes(HashSHA256, []byte("1")), Mode: newer.Files[0].Mode}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tx.Commit(5); err != nil {
+		t.Fatal(err)
+	}
+	if err = old.CheckTimestamp(appdir); err == nil {
+		t.Fatal("expect older manifest rejected")
+	}
+	if err = newer.CheckTimestamp(appdir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_HashAlgo(t *testing.T) {
+	wd, _ := os.Getwd()
+	md5Diff, err := CalcDiffOnFolders(path.Join(wd, "testdata/new"), path.Join(wd, "testdata/old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, algo := range []string{HashSHA256, HashBLAKE2b} {
+		req, err := MakeRequestWithHash(path.Join(wd, "testdata/old"), nil, true, algo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		diffMap, err := CalcDiff(path.Join(wd, "testdata/new"), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(diffMap) != len(md5Diff) {
+			t.Fatalf("%s: expect %d differences, got %d", algo, len(md5Diff), len(diffMap))
+		}
+		for k, d := range diffMap {
+			content, _ := ioutil.ReadFile(path.Join(wd, "testdata/new", k))
+			if d.NewHash != HashBytes(algo, content) {
+				t.Fatalf("%s: unexpected hash of %s", algo, k)
+			}
+		}
+	}
+	if _, err = MakeRequestWithHash(path.Join(wd, "testdata/old"), nil, true, "crc32"); err == nil {
+		t.Fatal("expect unsupported hash error")
+	}
+	if _, err = CalcDiff(path.Join(wd, "testdata/new"), &Request{HashAlgo: "crc32"}); err == nil {
+		t.Fatal("expect unsupported hash error")
+	}
+}
+
+func Test_HashIndex(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "gsync.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	ioutil.WriteFile(filepath.Join(dir, "1.txt"), []byte("1"), 0666)
+	ioutil.WriteFile(filepath.Join(dir, "2.txt"), []byte("2"), 0666)
+	os.Chtimes(filepath.Join(dir, "1.txt"), old, old)
+	os.Chtimes(filepath.Join(dir, "2.txt"), old, old)
+
+	idxfile := filepath.Join(dir, ".autoupdate.index")
+	idx := LoadHashIndex(idxfile)
+	req, err := MakeRequestWithIndex(dir, []string{".autoupdate.index"}, true, HashSHA256, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Files) != 2 || req.Hashes["1.txt"] != HashBytes(HashSHA256, []byte("1")) {
+		t.Fatalf("unexpected index %v", idx.Files)
+	}
+	if err = idx.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	//cached hash is used while stat data is unchanged
+	idx = LoadHashIndex(idxfile)
+	idx.Files["1.txt"].Hashes[HashSHA256] = "cached"
+	ioutil.WriteFile(filepath.Join(dir, "2.txt"), []byte("22"), 0666)
+	req, err = MakeRequestWithIndex(dir, []string{".autoupdate.index"}, true, HashSHA256, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Hashes["2.txt"] != HashBytes(HashSHA256, []byte("22")) {
+		t.Fatal("changed file should be rehashed")
+	}
+	if req.Hashes["1.txt"] != "cached" {
+		t.Fatal("unchanged file should not be rehashed")
+	}
+	if _, ok := idx.Files["2.txt"]; ok {
+		t.Fatal("file just modified should not be cached")
+	}
+	os.RemoveAll(dir)
+}
+
+func Test_Tree(t *testing.T) {
+	newdir, err := ioutil.TempDir(os.TempDir(), "gsync.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, _ := os.Getwd()
+	if err = copyDir(filepath.Join(wd, "testdata/new"), newdir, true); err != nil {
+		t.Fatal(err)
+	}
+	tree := NewTree(newdir)
+	if err = tree.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	for _, algo := range []string{HashMD5, HashSHA256} {
+		req, _ := MakeRequestWithHash(filepath.Join(wd, "testdata/old"), nil, true, algo)
+		expect, _ := CalcDiff(newdir, req)
+		diffMap, err := tree.CalcDiff(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(diffMap) != len(expect) {
+			t.Fatalf("%s: expect %d differences, got %d", algo, len(expect), len(diffMap))
+		}
+		for k, d := range expect {
+			if diffMap[k].NewHash != d.NewHash || diffMap[k].OldHash != d.OldHash {
+				t.Fatalf("%s: unexpected diff of %s", algo, k)
+			}
+		}
+	}
+
+	os.MkdirAll(filepath.Join(newdir, "sub"), 0777)
+	ioutil.WriteFile(filepath.Join(newdir, "sub", "4.txt"), []byte("4"), 0666)
+	os.Remove(filepath.Join(newdir, "0.txt"))
+	tree.Update(filepath.Join(newdir, "sub"))
+	tree.Update(filepath.Join(newdir, "0.txt"))
+	req := &Request{Hashes: map[string]string{"0.txt": "", "sub/4.txt": HashBytes(HashMD5, []byte("4"))}}
+	diffMap, _ := tree.CalcDiff(req)
+	if _, ok := diffMap["sub/4.txt"]; ok {
+		t.Fatal("new file should be in tree")
+	}
+	if deleted := tree.CalcDeleted(req); len(deleted) != 1 || deleted[0] != "0.txt" {
+		t.Fatalf("expect 0.txt deleted, got %v", deleted)
+	}
+	os.RemoveAll(filepath.Join(newdir, "sub"))
+	tree.Update(filepath.Join(newdir, "sub"))
+	if deleted := tree.CalcDeleted(req); len(deleted) != 2 {
+		t.Fatalf("expect sub dir removed from tree, got %v", deleted)
+	}
+	os.RemoveAll(newdir)
+}
+
+func Test_MerkleRoot(t *testing.T) {
+	files := map[string]string{"1.txt": "1", "a/2.txt": "2", "a/b/3.txt": "3", "c/4.txt": "4"}
+	dirs := MerkleDirs(files, HashSHA256)
+	if len(dirs) != 4 || dirs[""] != MerkleRoot(files, HashSHA256) {
+		t.Fatalf("unexpected dirs %v", dirs)
+	}
+	changed := map[string]string{"1.txt": "1", "a/2.txt": "2", "a/b/3.txt": "33", "c/4.txt": "4"}
+	changedDirs := MerkleDirs(changed, HashSHA256)
+	for _, dir := range []string{"", "a", "a/b"} {
+		if dirs[dir] == changedDirs[dir] {
+			t.Fatalf("hash of %s should change", dir)
+		}
+	}
+	if dirs["c"] != changedDirs["c"] {
+		t.Fatal("hash of c should not change")
+	}
+	//a file moved to a dir of the same name differs
+	moved := map[string]string{"1.txt": "1", "a/2.txt": "2", "a/b": "3", "c/4.txt": "4"}
+	if MerkleRoot(moved, HashSHA256) == dirs[""] {
+		t.Fatal("root should change")
+	}
+
+	dir, err := ioutil.TempDir(os.TempDir(), "gsync.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(dir, "sub"), 0777)
+	ioutil.WriteFile(filepath.Join(dir, "1.txt"), []byte("1"), 0666)
+	ioutil.WriteFile(filepath.Join(dir, "sub", "2.txt"), []byte("2"), 0666)
+	tree := NewTree(dir)
+	tree.Scan()
+	req, _ := MakeRequestWithHash(dir, nil, true, HashBLAKE2b)
+	if tree.RootHash(HashBLAKE2b) != MerkleRoot(req.Hashes, HashBLAKE2b) {
+		t.Fatal("root of tree and request should match")
+	}
+	ioutil.WriteFile(filepath.Join(dir, "sub", "2.txt"), []byte("22"), 0666)
+	tree.Update(filepath.Join(dir, "sub", "2.txt"))
+	if tree.RootHash(HashBLAKE2b) == MerkleRoot(req.Hashes, HashBLAKE2b) {
+		t.Fatal("root of tree should change")
+	}
+	os.RemoveAll(dir)
+}
+
+func Test_MerkleCompare(t *testing.T) {
+	server := map[string]string{"1.txt": "1", "a/2.txt": "2", "a/b/3.txt": "3", "c/4.txt": "4", "d/5.txt": "5"}
+	client := map[string]string{"1.txt": "1", "a/2.txt": "2", "a/b/3.txt": "33", "c/4.txt": "4", "e/6.txt": "6"}
+	remote := NewMerkleTree(server, HashSHA256)
+	local := NewMerkleTree(client, HashSHA256)
+
+	var scope []string
+	for dirs := []string{""}; len(dirs) > 0; {
+		var next []string
+		for _, dir := range dirs {
+			descend, paths := local.Compare(dir, remote.Children(dir))
+			next = append(next, descend...)
+			scope = append(scope, paths...)
+		}
+		dirs = next
+	}
+	sort.Strings(scope)
+	if fmt.Sprint(scope) != "[a/b/3.txt d/ e/]" {
+		t.Fatalf("unexpected scope %v", scope)
+	}
+	files := local.Files(scope)
+	if len(files) != 2 || files["e/6.txt"] != "6" {
+		t.Fatalf("unexpected files in scope %v", files)
+	}
+
+	dir, err := ioutil.TempDir(os.TempDir(), "gsync.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := range server {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(k)), 0777)
+		ioutil.WriteFile(filepath.Join(dir, k), []byte(k), 0666)
+	}
+	tree := NewTree(dir)
+	tree.Scan()
+	req := &Request{Hashes: map[string]string{"e/6.txt": "6"}, Scope: scope}
+	diffMap, _ := tree.CalcDiff(req)
+	if len(diffMap) != 2 || diffMap["d/5.txt"].NewHash == "" || diffMap["a/b/3.txt"].NewHash == "" {
+		t.Fatalf("unexpected diff in scope %v", diffMap)
+	}
+	if deleted := tree.CalcDeleted(req); len(deleted) != 1 || deleted[0] != "e/6.txt" {
+		t.Fatalf("expect e/6.txt deleted, got %v", deleted)
+	}
+	os.RemoveAll(dir)
+}
+
+func Test_Codec(t *testing.T) {
+	wd, _ := os.Getwd()
+	for _, codec := range []string{CodecGzip, CodecZstd, CodecNone} {
+		content := bytes.Repeat([]byte("gsync "), 1000)
+		compressed, err := Compress(content, codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cr, detected, err := DetectCodec(bytes.NewReader(compressed))
+		if err != nil || detected != codec {
+			t.Fatalf("expect codec %s, got %s %v", codec, detected, err)
+		}
+		decoded, _ := ioutil.ReadAll(cr)
+		if !bytes.Equal(decoded, content) {
+			t.Fatalf("%s: content changed", codec)
+		}
+
+		newdir := filepath.Join(wd, "testdata/new")
+		olddir, _ := ioutil.TempDir(os.TempDir(), "gsync.")
+		cachedir, _ := ioutil.TempDir(os.TempDir(), "gsync.")
+		copyDir(filepath.Join(wd, "testdata/old"), olddir, true)
+		diffMap, _ := CalcDiffOnFolders(newdir, olddir)
+		diffFile, err := PrepareDiffWithOptions(newdir, cachedir, diffMap, PatchOptions{Codec: codec})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(diffFile, CodecExt(codec)) {
+			t.Fatalf("unexpected patch file %s", diffFile)
+		}
+		df, _ := os.Open(diffFile)
+		_, err = ApplyDiff(olddir, df, diffMap, nil)
+		df.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diffMap, _ = CalcDiffOnFolders(newdir, olddir); len(diffMap) != 0 {
+			t.Fatalf("%s: apply failed. there're differences:%#v", codec, diffMap)
+		}
+		os.RemoveAll(olddir)
+		os.RemoveAll(cachedir)
+	}
+}
+
+func Test_NoCompress(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	if !Incompressible("a.bin", png, nil) || !Incompressible("a.ZIP", []byte("text"), nil) {
+		t.Fatal("expect compressed files detected")
+	}
+	if Incompressible("a.txt", []byte("text"), nil) || Incompressible("a.zip", []byte("text"), []string{".png"}) {
+		t.Fatal("expect text compressible")
+	}
+
+	noise := make([]byte, 300<<10)
+	rand.Read(noise)
+	text := bytes.Repeat([]byte("gsync "), 1000)
+	for _, codec := range []string{CodecGzip, CodecZstd, CodecNone} {
+		var buf bytes.Buffer
+		mw := &memberWriter{w: &buf, codec: codec}
+		for _, raw := range []bool{false, true, true, false, true} {
+			if err := mw.setRaw(raw); err != nil {
+				t.Fatal(err)
+			}
+			if raw {
+				mw.Write(noise)
+			} else {
+				mw.Write(text)
+			}
+		}
+		if err := mw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if codec != CodecNone && buf.Len() > 3*len(noise)+len(text) {
+			t.Fatalf("%s: text not compressed, size %d", codec, buf.Len())
+		}
+		cr, _, err := DetectCodec(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := ioutil.ReadAll(cr)
+		if err != nil {
+			t.Fatalf("%s: %v", codec, err)
+		}
+		expect := bytes.Join([][]byte{text, noise, noise, text, noise}, nil)
+		if !bytes.Equal(decoded, expect) {
+			t.Fatalf("%s: content changed", codec)
+		}
+	}
+}
+
+func Test_DiskCache(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "gsync.")
+	defer os.RemoveAll(dir)
+	write := func(name string, age time.Duration) string {
+		fpath := filepath.Join(dir, name)
+		ioutil.WriteFile(fpath, make([]byte, 100), 0666)
+		modTime := time.Now().Add(-age)
+		os.Chtimes(fpath, modTime, modTime)
+		return fpath
+	}
+	exists := func(fpath string) bool {
+		_, err := os.Stat(fpath)
+		return err == nil
+	}
+	old := write("old", 2*time.Hour)
+	a := write("a", 3*time.Minute)
+	b := write("b", 2*time.Minute)
+	c := NewDiskCache(dir, 250, time.Hour)
+	if err := c.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if exists(old) || !exists(a) || !exists(b) || c.Size() != 200 {
+		t.Fatalf("expect expired file removed, size %d", c.Size())
+	}
+
+	//a is streamed and accessed recently, so b is removed when c is added
+	release, ok := c.Acquire(a)
+	if !ok {
+		t.Fatal("expect loaded file acquired")
+	}
+	if _, ok = c.Acquire(old); ok {
+		t.Fatal("expect removed file not acquired")
+	}
+	c.Add(write("c", 0))
+	if !exists(a) || exists(b) {
+		t.Fatal("expect least recently accessed file removed")
+	}
+	//a is not removed while being read, the next least recently accessed file is
+	cf := filepath.Join(dir, "c")
+	c.Add(write("d", 0))
+	release()
+	if !exists(a) || exists(cf) || c.Size() != 200 {
+		t.Fatalf("expect file in use kept, size %d", c.Size())
+	}
+
+	//a file added again while being read is kept until the reader releases it
+	_, release, err := c.AddAndAcquire(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Add(write("a", 0))
+	c.Add(write("e", 0))
+	c.Add(write("f", 0))
+	if !exists(a) {
+		t.Fatal("expect file in use kept after added again")
+	}
+	release()
+	c.Add(write("g", 0))
+	if exists(a) || c.Size() != 200 {
+		t.Fatalf("expect released file removed, size %d", c.Size())
+	}
+}
+
+func Test_PrepareDiffConcurrent(t *testing.T) {
+	wd, _ := os.Getwd()
+	newdir := filepath.Join(wd, "testdata/new")
+	olddir, _ := ioutil.TempDir(os.TempDir(), "gsync.")
+	cachedir, _ := ioutil.TempDir(os.TempDir(), "gsync.")
+	defer os.RemoveAll(olddir)
+	defer os.RemoveAll(cachedir)
+	copyDir(filepath.Join(wd, "testdata/old"), olddir, true)
+	diffMap, _ := CalcDiffOnFolders(newdir, olddir)
+
+	names := make(chan string, 10)
+	for i := 0; i < cap(names); i++ {
+		go func() {
+			fname, err := PrepareDiffWithOptions(newdir, cachedir, diffMap, PatchOptions{Codec: CodecZstd})
+			if err != nil {
+				t.Error(err)
+			}
+			names <- fname
+		}()
+	}
+	fname := <-names
+	for i := 1; i < cap(names); i++ {
+		if name := <-names; name != fname {
+			t.Fatalf("expect patch %s, got %s", fname, name)
+		}
+	}
+	if files, _ := ioutil.ReadDir(cachedir); len(files) != 2 {
+		t.Fatalf("expect only the patch and its manifest in cache dir, got %d files", len(files))
+	}
+	df, _ := os.Open(fname)
+	_, err := ApplyDiff(olddir, df, diffMap, nil)
+	df.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffMap, _ = CalcDiffOnFolders(newdir, olddir); len(diffMap) != 0 {
+		t.Fatalf("apply failed. there're differences:%#v", diffMap)
+	}
+}
+
+func Test_PatchKey(t *testing.T) {
+	wd, _ := os.Getwd()
+	newdir := filepath.Join(wd, "testdata/new")
+	cachedir, _ := ioutil.TempDir(os.TempDir(), "gsync.")
+	defer os.RemoveAll(cachedir)
+	diffMap, _ := CalcDiffOnFolders(newdir, filepath.Join(wd, "testdata/old"))
+	prepare := func(app string, diff DiffMap) string {
+		fname, err := PrepareDiffWithOptions(newdir, cachedir, diff, PatchOptions{App: app, Codec: CodecGzip})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fname
+	}
+	fname := prepare("app", diffMap)
+	for i := 0; i < 5; i++ {
+		if name := prepare("app", diffMap); name != fname {
+			t.Fatalf("expect patch %s, got %s", fname, name)
+		}
+	}
+	if name := prepare("app2", diffMap); name == fname {
+		t.Fatal("expect patches of apps apart")
+	}
+	//the same content under another path
+	moved := make(DiffMap)
+	for k, v := range diffMap {
+		moved["moved/"+k] = v
+	}
+	if newPatchManifest("app", moved, CodecGzip).key() == newPatchManifest("app", diffMap, CodecGzip).key() {
+		t.Fatal("expect patches of different paths apart")
+	}
+
+	m, err := CheckPatch(fname)
+	if err != nil || m.App != "app" || len(m.Files) != len(diffMap) {
+		t.Fatalf("unexpected manifest %#v %v", m, err)
+	}
+	//a truncated patch is rebuilt
+	os.Truncate(fname, 10)
+	if _, err = CheckPatch(fname); err == nil {
+		t.Fatal("expect truncated patch invalid")
+	}
+	prepare("app", diffMap)
+	if _, err = CheckPatch(fname); err != nil {
+		t.Fatal(err)
+	}
+	//so is a patch changed in the same size
+	content, _ := ioutil.ReadFile(fname)
+	content[len(content)/2] ^= 0xff
+	ioutil.WriteFile(fname, content, 0644)
+	if _, err = CheckPatch(fname); err == nil {
+		t.Fatal("expect changed patch invalid")
+	}
+	prepare("app", diffMap)
+	if _, err = CheckPatch(fname); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := ioutil.ReadDir(cachedir); len(files) != 4 {
+		t.Fatalf("expect no temp files left in cache dir, got %d files", len(files))
+	}
+}
+
+func Test_StagePatch(t *testing.T) {
+	wd, _ := os.Getwd()
+	newdir := filepath.Join(wd, "testdata/new")
+	olddir, _ := ioutil.TempDir(os.TempDir(), "gsync.")
+	cachedir, _ := ioutil.TempDir(os.TempDir(), "gsync.")
+	defer os.RemoveAll(olddir)
+	defer os.RemoveAll(cachedir)
+	copyDir(filepath.Join(wd, "testdata/old"), olddir, true)
+	diffMap, _ := CalcDiffOnFolders(newdir, olddir)
+	fname, err := PrepareDiffWithOptions(newdir, cachedir, diffMap, PatchOptions{Codec: CodecZstd})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//files of the patch must be in the diff
+	tx, _ := BeginTransaction(olddir)
+	df, _ := os.Open(fname)
+	partial := make(DiffMap)
+	for k, v := range diffMap {
+		partial[k] = v
+		break
+	}
+	if _, err = tx.StagePatch(df, partial); err == nil || len(diffMap) == 1 {
+		t.Fatal("expect files not in diff rejected")
+	}
+	df.Close()
+	tx.Abort()
+
+	tx, _ = BeginTransaction(olddir)
+	df, _ = os.Open(fname)
+	staged, err := tx.StagePatch(df, diffMap)
+	df.Close()
+	if err != nil || len(staged) != len(diffMap) {
+		t.Fatalf("expect %d files staged, got %d %v", len(diffMap), len(staged), err)
+	}
+	if _, err = tx.Commit(5); err != nil {
+		t.Fatal(err)
+	}
+	if diffMap, _ = CalcDiffOnFolders(newdir, olddir); len(diffMap) != 0 {
+		t.Fatalf("apply failed. there're differences:%#v", diffMap)
+	}
+}
+
+func Test_RollbackIncompleteBackup(t *testing.T) {
+	appdir, _ := ioutil.TempDir(os.TempDir(), "gsync.")
+	defer os.RemoveAll(appdir)
+	ioutil.WriteFile(filepath.Join(appdir, "1.txt"), []byte("old content"), 0666)
+	newContent := []byte("new content")
+	diff := Diff{NewHash: fmt.Sprintf("%x", md5.Sum(newContent)), Mode: 0666, ModTime: time.Now()}
+	tx, _ := BeginTransaction(appdir)
+	tx.Stage("1.txt", newContent, diff)
+	if _, err := tx.Commit(5); err != nil {
+		t.Fatal(err)
+	}
+
+	//the next update crashed after backing up files but before writing its journal
+	time.Sleep(time.Millisecond)
+	tx, _ = BeginTransaction(appdir)
+	tx.Stage("1.txt", []byte("newer content"), Diff{NewHash: fmt.Sprintf("%x", md5.Sum([]byte("newer content")))})
+	backup, _ := BeginBackup(appdir)
+	backup.Save("1.txt")
+	if backups, _ := Backups(appdir); len(backups) != 1 {
+		t.Fatalf("expect incomplete backup not listed, got %d backups", len(backups))
+	}
+	if recovered, err := RecoverTransaction(appdir, 5); err != nil || recovered {
+		t.Fatalf("expect nothing to recover. got %v %v", recovered, err)
+	}
+	if fexists(backup.dir()) {
+		t.Fatal("expect incomplete backup removed")
+	}
+
+	if _, err := Rollback(appdir, 1); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadFile(filepath.Join(appdir, "1.txt"))
+	if string(content) != "old content" {
+		t.Fatalf("expect the last real update rolled back, got %s", content)
+	}
+}
+
+func Test_RecoverFailingApply(t *testing.T) {
+	appdir, _ := ioutil.TempDir(os.TempDir(), "gsync.")
+	defer os.RemoveAll(appdir)
+	ioutil.WriteFile(filepath.Join(appdir, "1.txt"), []byte("old content"), 0666)
+	stage := func(tx *Transaction, name string, content string) {
+		if err := tx.Stage(name, []byte(content), Diff{NewHash: fmt.Sprintf("%x", md5.Sum([]byte(content))), Mode: 0666, ModTime: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx, _ := BeginTransaction(appdir)
+	stage(tx, "1.txt", "new content")
+	stage(tx, "2.txt", "new file")
+	//a staged file which can't be read fails every apply
+	staged := filepath.Join(tx.dir(), "2.txt")
+	os.Remove(staged)
+	os.MkdirAll(filepath.Join(staged, "x"), 0777)
+	if _, err := tx.Commit(5); err == nil {
+		t.Fatal("expect apply failed")
+	}
+
+	if recovered, err := RecoverTransaction(appdir, 5); err != nil || !recovered {
+		t.Fatalf("expect failed update reverted. got %v %v", recovered, err)
+	}
+	content, _ := ioutil.ReadFile(filepath.Join(appdir, "1.txt"))
+	if string(content) != "old content" || fexists(filepath.Join(appdir, "2.txt")) {
+		t.Fatalf("expect files restored, got %s", content)
+	}
+	if recovered, err := RecoverTransaction(appdir, 5); err != nil || recovered {
+		t.Fatalf("expect nothing to recover again. got %v %v", recovered, err)
+	}
+
+	//updates go on
+	tx, _ = BeginTransaction(appdir)
+	stage(tx, "2.txt", "new file")
+	if _, err := tx.Commit(5); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ = ioutil.ReadFile(filepath.Join(appdir, "2.txt")); string(content) != "new file" {
+		t.Fatalf("expect update applied, got %s", content)
+	}
+}
+
+func Test_DiffDirs(t *testing.T) {
+	old := []string{"/srv/a", "/srv/b", "/srv/b/nested", "/srv/c/"}
+	dirs := []string{"/srv/b/nested", "/srv/c", "/srv/d", "/srv/d"}
+	added, removed := DiffDirs(old, dirs)
+	if len(added) != 1 || added[0] != "/srv/d" {
+		t.Fatalf("unexpected added dirs %v", added)
+	}
+	if len(removed) != 2 || removed[0] != "/srv/a" || removed[1] != "/srv/b" {
+		t.Fatalf("unexpected removed dirs %v", removed)
+	}
+	if added, removed = DiffDirs(nil, nil); len(added) != 0 || len(removed) != 0 {
+		t.Fatal("expect no change of empty dirs")
+	}
+
+	cases := []struct {
+		path string
+		in   bool
+	}{
+		{"/srv/b/nested", true},
+		{"/srv/b/nested/sub", true},
+		{"/srv/b", false},
+		{"/srv/b/other", false},
+		{"/srv/bb", false},
+		{"/srv/c/x", true},
+		{"/srv/c2", false},
+	}
+	for _, c := range cases {
+		if InDirs(c.path, dirs) != c.in {
+			t.Errorf("expect InDirs(%s) %v", c.path, c.in)
+		}
+	}
+}
+
+func Test_JoinDir(t *testing.T) {
+	dir := filepath.FromSlash("/srv/app")
+	for _, name := range []string{"a.txt", "/sub/b.txt", "sub/../c.txt", "..c.txt"} {
+		if _, err := JoinDir(dir, name); err != nil {
+			t.Errorf("expect %s in dir, got %v", name, err)
+		}
+	}
+	for _, name := range []string{"..", "../config.txt", "/../../keys/app.key", "sub/../../x"} {
+		if fp, err := JoinDir(dir, name); err == nil {
+			t.Errorf("expect %s rejected, got %s", name, fp)
+		}
+	}
+	if _, err := ReleaseDir(dir, "-1/../../.."); err == nil {
+		t.Error("expect invalid release rejected")
+	}
+}
@@ -0,0 +1,273 @@
+package gsync
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const journalFile = "journal.json"
+
+//Transaction stages all files of an update and then applies them together.
+//a journal is kept while applying, so an interrupted update can be recovered
+type Transaction struct {
+	ID      string
+	Files   DiffMap
+	Removes []string
+	Ignore  []string
+	//HashAlgo is the algorithm of hashes in staged diffs, md5 if empty
+	HashAlgo string
+	//Backup is the id of the backup taken before applying
+	Backup string
+	//Manifest if set must contain every staged file
+	Manifest *Manifest `json:"-"`
+	//ManifestTime is the timestamp of Manifest, kept as the last applied once the update is done
+	ManifestTime int64
+
+	applydir string
+	mu       sync.Mutex
+}
+
+func stagingDir(applydir string) string {
+	return filepath.Join(applydir, StateDir, "staging")
+}
+
+func (t *Transaction) dir() string {
+	return filepath.Join(stagingDir(t.applydir), t.ID)
+}
+
+func (t *Transaction) writeJournal() error {
+	content, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	tmpfile := filepath.Join(t.applydir, StateDir, journalFile+".tmp")
+	if err = ioutil.WriteFile(tmpfile, content, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmpfile, filepath.Join(t.applydir, StateDir, journalFile))
+}
+
+//BeginTransaction starts an update of applydir
+func BeginTransaction(applydir string) (*Transaction, error) {
+	t := &Transaction{
+		ID:       time.Now().Format("20060102-150405.000000"),
+		Files:    make(DiffMap),
+		applydir: applydir,
+	}
+	if err := os.MkdirAll(t.dir(), 0777); err != nil {
+		return nil, err
+	}
+	HideFile(filepath.Join(applydir, StateDir))
+	return t, nil
+}
+
+//Stage checks content of file name against d and keeps it until commit
+func (t *Transaction) Stage(name string, content []byte, d Diff) error {
+	if hash := HashBytes(t.HashAlgo, content); hash != d.NewHash {
+		return fmt.Errorf("file %s hash check failed. expect %s, got %s", name, d.NewHash, hash)
+	}
+	if t.Manifest != nil {
+		if err := t.Manifest.Check(name, content, d.Mode); err != nil {
+			return err
+		}
+	}
+	fpath := filepath.Join(t.dir(), filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(fpath), 0777); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(fpath, content, 0666); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.Files[name] = d
+	t.mu.Unlock()
+	return nil
+}
+
+//StageLocalCopies stages diffs which can be copied from other files in the app dir
+func (t *Transaction) StageLocalCopies(diff DiffMap) ([]string, error) {
+	copies := make([]string, 0)
+	for k, content := range readLocalCopies(t.applydir, diff, t.HashAlgo) {
+		if err := t.Stage(k, content, diff[k]); err != nil {
+			return copies, err
+		}
+		copies = append(copies, k)
+	}
+	sort.Strings(copies)
+	return copies, nil
+}
+
+//StagePatch stages files of patch df, a tar written by PrepareDiff. files must be in diff
+func (t *Transaction) StagePatch(df io.Reader, diff DiffMap) ([]string, error) {
+	staged := make([]string, 0)
+	cr, _, err := DetectCodec(df)
+	if err != nil {
+		return staged, err
+	}
+	defer cr.Close()
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return staged, err
+		}
+		d, ok := diff[hdr.Name]
+		if !ok {
+			return staged, fmt.Errorf("file %s of patch is not in diff", hdr.Name)
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return staged, err
+		}
+		if err = t.Stage(hdr.Name, content, d); err != nil {
+			return staged, err
+		}
+		staged = append(staged, hdr.Name)
+	}
+	sort.Strings(staged)
+	return staged, nil
+}
+
+//Remove marks files to be removed on commit. files matching ignore are kept
+func (t *Transaction) Remove(files []string, ignore []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Removes = append(t.Removes, files...)
+	t.Ignore = ignore
+}
+
+//Abort drops all staged files, the app dir is left untouched
+func (t *Transaction) Abort() error {
+	return os.RemoveAll(t.dir())
+}
+
+//Commit backs up files to be changed and then applies the staged files and removes.
+//at most keepBackups backups are kept
+func (t *Transaction) Commit(keepBackups int) ([]string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	backup, err := BeginBackup(t.applydir)
+	if err != nil {
+		return nil, err
+	}
+	for name := range t.Files {
+		if err = backup.Save(name); err != nil {
+			backup.Discard()
+			return nil, err
+		}
+	}
+	for _, name := range t.Removes {
+		if err = backup.Save(name); err != nil {
+			backup.Discard()
+			return nil, err
+		}
+	}
+	t.Backup = backup.ID
+	if t.Manifest != nil {
+		t.ManifestTime = t.Manifest.Timestamp
+	}
+	if err = t.writeJournal(); err != nil {
+		backup.Discard()
+		return nil, err
+	}
+	return t.apply(backup, keepBackups)
+}
+
+//apply writes staged files into the app dir. it may be run again after an interruption
+func (t *Transaction) apply(backup *Backup, keepBackups int) ([]string, error) {
+	updates := make([]string, 0)
+	names := make([]string, 0, len(t.Files))
+	for name := range t.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		d := t.Files[name]
+		content, err := ioutil.ReadFile(filepath.Join(t.dir(), filepath.FromSlash(name)))
+		if err != nil {
+			return updates, err
+		}
+		dst := filepath.Join(t.applydir, filepath.FromSlash(name))
+		if err = ReplaceFile(content, dst, d.Mode, d.ModTime); err != nil {
+			return updates, err
+		}
+		updates = append(updates, dst)
+	}
+	removes, err := RemoveFiles(t.applydir, t.Removes, t.Ignore)
+	updates = append(updates, removes...)
+	if err != nil {
+		return updates, err
+	}
+	if err = saveManifestTime(t.applydir, t.ManifestTime); err != nil {
+		return updates, err
+	}
+
+	if err = backup.Commit(keepBackups); err != nil {
+		return updates, err
+	}
+	if err = os.Remove(filepath.Join(t.applydir, StateDir, journalFile)); err != nil {
+		return updates, err
+	}
+	return updates, t.Abort()
+}
+
+//RecoverTransaction completes an update of applydir interrupted while applying.
+//if the staged files are gone or applying them fails again, the update is reverted from its backup instead
+func RecoverTransaction(applydir string, keepBackups int) (bool, error) {
+	//staged files and backups without journal belong to updates never committed
+	defer func() {
+		if !fexists(filepath.Join(applydir, StateDir, journalFile)) {
+			os.RemoveAll(stagingDir(applydir))
+			removeIncompleteBackups(applydir, "")
+		}
+	}()
+
+	content, err := ioutil.ReadFile(filepath.Join(applydir, StateDir, journalFile))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	t := &Transaction{applydir: applydir}
+	if err = json.Unmarshal(content, t); err != nil {
+		return false, err
+	}
+	backup, err := loadBackup(applydir, t.Backup)
+	if err != nil {
+		return false, err
+	}
+
+	complete := true
+	for name := range t.Files {
+		if !fexists(filepath.Join(t.dir(), filepath.FromSlash(name))) {
+			complete = false
+			break
+		}
+	}
+	if complete {
+		if _, err = t.apply(backup, keepBackups); err == nil {
+			return true, nil
+		}
+		//files may be locked or not writable, the update is reverted instead of being retried forever
+	}
+
+	if _, err = backup.restore(); err != nil {
+		return false, err
+	}
+	if err = os.Remove(filepath.Join(applydir, StateDir, journalFile)); err != nil {
+		return false, err
+	}
+	return true, t.Abort()
+}
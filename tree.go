@@ -0,0 +1,251 @@
+package gsync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//TreeFile describes a file of a Tree
+type TreeFile struct {
+	//Hashes by hash algorithm
+	Hashes  map[string]string
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+}
+
+//Tree keeps hashes of all files in a dir, so diffs are calculated without reading files.
+//it is kept up to date by calling Update with changed paths
+type Tree struct {
+	dir   string
+	mu    sync.RWMutex
+	files map[string]*TreeFile
+	//merkles caches merkle trees by hash algorithm
+	merkles map[string]*MerkleTree
+}
+
+//NewTree creates an empty tree of dir, call Scan to fill it
+func NewTree(dir string) *Tree {
+	return &Tree{
+		dir:     filepath.Clean(dir),
+		files:   make(map[string]*TreeFile),
+		merkles: make(map[string]*MerkleTree),
+	}
+}
+
+//Dir returns the dir of the tree
+func (t *Tree) Dir() string {
+	return t.dir
+}
+
+//relPath returns path of fpath relative to the tree dir, false if fpath is outside
+func (t *Tree) relPath(fpath string) (string, bool) {
+	fpath = filepath.Clean(fpath)
+	if fpath == t.dir {
+		return "", true
+	}
+	if !strings.HasPrefix(fpath, t.dir+string(filepath.Separator)) {
+		return "", false
+	}
+	return normpath(fpath[len(t.dir)+1:]), true
+}
+
+func hashTreeFile(fpath string) (*TreeFile, error) {
+	fr, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer fr.Close()
+	fi, err := fr.Stat()
+	if err != nil {
+		return nil, err
+	}
+	hashes, err := hashAll(fr)
+	if err != nil {
+		return nil, err
+	}
+	return &TreeFile{Hashes: hashes, Size: fi.Size(), Mode: fi.Mode(), ModTime: fi.ModTime()}, nil
+}
+
+//Scan hashes all files of the dir. requests wait until scanning is done
+func (t *Tree) Scan() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	files := make(map[string]*TreeFile)
+	err := filepath.Walk(t.dir, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, _ := t.relPath(fpath)
+		f, err := hashTreeFile(fpath)
+		if err != nil {
+			return fmt.Errorf("hash file %s err:%v", fpath, err)
+		}
+		files[rel] = f
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	t.files = files
+	t.merkles = make(map[string]*MerkleTree)
+	return nil
+}
+
+//Update rehashes fpath after it was changed. fpath may be a file or a dir,
+//files under it are removed from the tree if it doesn't exist any more
+func (t *Tree) Update(fpath string) error {
+	rel, ok := t.relPath(fpath)
+	if !ok {
+		return nil
+	}
+	fi, err := os.Stat(fpath)
+	if os.IsNotExist(err) {
+		t.remove(rel)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return filepath.Walk(fpath, func(p string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			return t.Update(p)
+		})
+	}
+
+	//hash without holding the lock, the result is dropped if the file changed meanwhile
+	f, err := hashTreeFile(fpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			t.remove(rel)
+			return nil
+		}
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if fi, err = os.Stat(fpath); err != nil || fi.Size() != f.Size || !fi.ModTime().Equal(f.ModTime) {
+		return nil
+	}
+	t.files[rel] = f
+	t.merkles = make(map[string]*MerkleTree)
+	return nil
+}
+
+//remove drops file rel and all files under it
+func (t *Tree) remove(rel string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.merkles = make(map[string]*MerkleTree)
+	if len(rel) == 0 {
+		t.files = make(map[string]*TreeFile)
+		return
+	}
+	delete(t.files, rel)
+	for k := range t.files {
+		if strings.HasPrefix(k, rel+"/") {
+			delete(t.files, k)
+		}
+	}
+}
+
+//CalcDiff calcs diffrence on req with files of the tree
+func (t *Tree) CalcDiff(req *Request) (DiffMap, error) {
+	algo := HashName(req.HashAlgo)
+	if !SupportedHash(algo) {
+		return nil, fmt.Errorf("unsupported hash algorithm %s", req.HashAlgo)
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	scope := newScope(req.Scope)
+	diffMap := make(DiffMap)
+	for k, f := range t.files {
+		if len(req.Scope) > 0 && !scope.contains(k) {
+			continue
+		}
+		newHash := f.Hashes[algo]
+		if oldHash := req.Hashes[k]; newHash != oldHash {
+			diffMap[k] = Diff{
+				NewHash: newHash,
+				OldHash: oldHash,
+				NewSize: f.Size,
+				Mode:    f.Mode,
+				ModTime: f.ModTime,
+			}
+		}
+	}
+	if req.ClientVersion >= 3 {
+		detectCopies(req, diffMap)
+	}
+	return diffMap, nil
+}
+
+//CalcDeleted lists files in req which don't exist in the tree
+func (t *Tree) CalcDeleted(req *Request) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	deleted := make([]string, 0)
+	for k := range req.Hashes {
+		if _, ok := t.files[k]; !ok {
+			deleted = append(deleted, k)
+		}
+	}
+	sort.Strings(deleted)
+	return deleted
+}
+
+//merkle returns the merkle tree of files hashed with algo, t.mu must be locked
+func (t *Tree) merkle(algo string) *MerkleTree {
+	if m, ok := t.merkles[algo]; ok {
+		return m
+	}
+	files := make(map[string]string, len(t.files))
+	for k, f := range t.files {
+		files[k] = f.Hashes[algo]
+	}
+	m := NewMerkleTree(files, algo)
+	t.merkles[algo] = m
+	return m
+}
+
+//RootHash returns the merkle root of files hashed with algo
+func (t *Tree) RootHash(algo string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.merkle(HashName(algo)).Root()
+}
+
+//MerkleChildren lists children of dirs in the merkle tree of files hashed with algo
+func (t *Tree) MerkleChildren(algo string, dirs []string) map[string][]TreeNode {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m := t.merkle(HashName(algo))
+	children := make(map[string][]TreeNode)
+	for _, dir := range dirs {
+		children[dir] = m.Children(dir)
+	}
+	return children
+}
+
+//Manifest describes files of the tree
+func (t *Tree) Manifest(app string, release string) *Manifest {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	m := &Manifest{App: app, Release: release, Files: make([]ManifestFile, 0, len(t.files))}
+	for k, f := range t.files {
+		m.Files = append(m.Files, ManifestFile{Path: k, SHA256: f.Hashes[HashSHA256], Size: f.Size, Mode: f.Mode})
+	}
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Path < m.Files[j].Path })
+	return m
+}